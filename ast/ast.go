@@ -0,0 +1,77 @@
+// Package ast declares the types used to represent package clauses,
+// import and use clauses, and function declarations of Slick source
+// files, as built from the forms returned by the reader. Types and
+// expressions remain raw forms, since they are subject to macro
+// expansion.
+package ast
+
+import (
+	"go/token"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+// A Node is a syntax tree node, built from a form.
+type Node interface {
+	// Form returns the form the node was built from.
+	Form() *list.Pair
+	// Pos returns the position of the first character of the form, or
+	// token.NoPos if the form was not read from source, for example
+	// because it is the result of a macro expansion.
+	Pos() token.Pos
+	// End returns the position of the first character after the form.
+	End() token.Pos
+}
+
+// A Span records the form a node was built from and its source range.
+type Span struct {
+	form     *list.Pair
+	pos, end token.Pos
+}
+
+func (s Span) Form() *list.Pair { return s.form }
+func (s Span) Pos() token.Pos   { return s.pos }
+func (s Span) End() token.Pos   { return s.end }
+
+type (
+	// A PackageClause represents a package clause.
+	PackageClause struct {
+		Span
+		Name         *lib.Symbol
+		Doc          string
+		ExternalTest bool // :external-test
+	}
+
+	// An ImportSpec represents a single import or use clause. A clause
+	// that consists of a path string only has no span of its own, but
+	// the span of the enclosing declaration.
+	ImportSpec struct {
+		Span
+		Name      *lib.Symbol // nil if the clause is a path string
+		Path      string
+		Doc       string
+		Quoted    bool
+		Condition string // "" if there is no :when condition
+	}
+
+	// A Field represents an entry in a parameter or result list.
+	Field struct {
+		Span
+		Names    []*lib.Symbol
+		Variadic bool
+		Type     interface{}
+	}
+
+	// A FuncDecl represents a function or method declaration.
+	FuncDecl struct {
+		Span
+		Recv    []*Field // nil for functions
+		Name    *lib.Symbol
+		Params  []*Field
+		Results []*Field
+		Doc     string
+		Body    *list.Pair
+		HasBody bool // false for functions implemented outside Go
+	}
+)
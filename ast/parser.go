@@ -0,0 +1,353 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+var (
+	_package  = lib.Intern("", "package")
+	_quote    = lib.Intern("", "quote")
+	_ellipsis = lib.Intern("", "...")
+
+	keyExternalTest = lib.Intern("_keyword", "external-test")
+	keyWhen         = lib.Intern("_keyword", "when")
+)
+
+// A Parser builds syntax tree nodes from forms read by a reader.
+type Parser struct {
+	Reader *reader.Reader
+
+	// Error is called for each syntax error, with the form that contains
+	// the error. If Error is nil, errors are added to the errors of the
+	// reader.
+	Error func(form *list.Pair, msg string)
+}
+
+// NewParser returns a parser for the forms read by rd.
+func NewParser(rd *reader.Reader) *Parser {
+	return &Parser{Reader: rd}
+}
+
+func (p *Parser) error(form *list.Pair, msg string) {
+	if p.Error != nil {
+		p.Error(form, msg)
+		return
+	}
+	pos, _ := p.Reader.FormPos(form)
+	offset := 0
+	if pos.IsValid() {
+		offset = p.Reader.File().Offset(pos)
+	}
+	p.Reader.Error(offset, msg)
+}
+
+func (p *Parser) span(form *list.Pair) Span {
+	pos, end := p.Reader.FormPos(form)
+	return Span{form, pos, end}
+}
+
+// ValidGoIdentifier reports whether lit is a valid Go identifier.
+func ValidGoIdentifier(lit string) bool {
+	if len(lit) == 0 {
+		return false
+	}
+	for i, r := range lit {
+		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidSimpleIdentifier reports whether sym is an unqualified identifier
+// that is a valid Go identifier.
+func ValidSimpleIdentifier(sym *lib.Symbol) bool {
+	return sym.Package == "" && ValidGoIdentifier(sym.Identifier)
+}
+
+// ValidImportPath reports whether lit is a valid import path.
+func ValidImportPath(lit string) bool {
+	const illegalChars = `!"#$%&'()*,:;<=>?[\]^{|}` + "`�"
+	for _, r := range lit {
+		if !unicode.IsGraphic(r) || unicode.IsSpace(r) || strings.ContainsRune(illegalChars, r) {
+			return false
+		}
+	}
+	return lit != ""
+}
+
+// Symbols returns the symbols of a symbol or of a proper list of symbols,
+// or nil if x is neither.
+func Symbols(x interface{}) []*lib.Symbol {
+	switch e := x.(type) {
+	case *lib.Symbol:
+		return []*lib.Symbol{e}
+	case *list.Pair:
+		if !list.IsProper(e) || !e.Every(func(x interface{}) bool { _, ok := x.(*lib.Symbol); return ok }) {
+			return nil
+		}
+		return e.AppendToSlice([]*lib.Symbol(nil)).([]*lib.Symbol)
+	}
+	return nil
+}
+
+// PackageClause builds the node for a package clause. It returns nil if
+// the package name is invalid.
+func (p *Parser) PackageClause(form *list.Pair) *PackageClause {
+	if !list.IsProper(form) {
+		p.error(form, "package clause has invalid length")
+		return nil
+	}
+	pkgClause := form.ToSlice()
+	if len(pkgClause) < 2 || len(pkgClause) > 4 {
+		p.error(form, "package clause has invalid length")
+		return nil
+	}
+	if pkgClause[0] != _package {
+		p.error(form, "package clause starts with invalid keyword")
+	}
+	clause := &PackageClause{Span: p.span(form)}
+	sym, ok := pkgClause[1].(*lib.Symbol)
+	if !ok {
+		p.error(form, "package name is not an identifier")
+		return nil
+	}
+	if !ValidSimpleIdentifier(sym) || sym.Identifier == "_" {
+		p.error(form, "invalid package name")
+		return nil
+	}
+	clause.Name = sym
+	options := pkgClause[2:]
+	if n := len(options); n > 0 && options[n-1] == keyExternalTest {
+		if strings.HasSuffix(sym.Identifier, "_test") {
+			p.error(form, fmt.Sprintf("package name %v of external test package already ends in _test", sym))
+		}
+		clause.ExternalTest = true
+		options = options[:n-1]
+	}
+	if len(options) > 1 {
+		p.error(form, "package clause has invalid length")
+	}
+	if len(options) == 1 {
+		if comment, ok := options[0].(string); !ok {
+			p.error(form, "package comment is not a string")
+		} else {
+			clause.Doc = comment
+		}
+	}
+	return clause
+}
+
+// condition removes a trailing :when condition from the elements of an
+// import or use clause.
+func (p *Parser) condition(clause *list.Pair, elements []interface{}) ([]interface{}, string, bool) {
+	n := len(elements)
+	if n < 2 || elements[n-2] != keyWhen {
+		return elements, "", true
+	}
+	cond, ok := elements[n-1].(string)
+	if !ok {
+		p.error(clause, "clause condition is not a string")
+	}
+	return elements[:n-2], cond, ok
+}
+
+// ImportSpec builds the node for an element of an import declaration, or
+// of a use declaration if use is true. It returns nil if the element is
+// invalid.
+func (p *Parser) ImportSpec(decl *list.Pair, element interface{}, use bool) *ImportSpec {
+	kind, noun, quotedDecl := "import", "import", "import"
+	if use {
+		kind, noun, quotedDecl = "use", "plugin", "use declaration"
+	}
+	if path, ok := element.(string); ok {
+		if !ValidImportPath(path) {
+			p.error(decl, fmt.Sprintf("invalid %v path: %v", noun, path))
+			return nil
+		}
+		return &ImportSpec{Span: p.span(decl), Path: path}
+	}
+	inner, ok := element.(*list.Pair)
+	if !ok || inner == nil || !list.IsProper(inner) {
+		p.error(decl, fmt.Sprintf("invalid %v clause", kind))
+		return nil
+	}
+	spec := &ImportSpec{Span: p.span(inner)}
+	imp, cond, ok := p.condition(inner, inner.ToSlice())
+	if !ok {
+		return nil
+	}
+	spec.Condition = cond
+	if len(imp) < 2 || len(imp) > 3 {
+		p.error(inner, fmt.Sprintf("%v clause has invalid length", kind))
+		return nil
+	}
+	if imp[0] == _quote {
+		spec.Quoted = true
+		quoted, ok := imp[1].(*list.Pair)
+		if len(imp) != 2 || !ok || quoted == nil || !list.IsProper(quoted) {
+			p.error(inner, fmt.Sprintf("invalid quoted %v", quotedDecl))
+			return nil
+		}
+		imp, cond, ok = p.condition(quoted, quoted.ToSlice())
+		if !ok {
+			return nil
+		}
+		if cond != "" {
+			if spec.Condition != "" {
+				spec.Condition = "(" + spec.Condition + ") && (" + cond + ")"
+			} else {
+				spec.Condition = cond
+			}
+		}
+		if len(imp) < 2 || len(imp) > 3 {
+			p.error(inner, fmt.Sprintf("quoted %v clause has invalid length", kind))
+			return nil
+		}
+	}
+	ident, ok := imp[0].(*lib.Symbol)
+	if !ok {
+		p.error(inner, fmt.Sprintf("%v name is not an identifier", noun))
+		return nil
+	}
+	if !ValidSimpleIdentifier(ident) {
+		p.error(inner, fmt.Sprintf("invalid %v identifier", noun))
+		return nil
+	}
+	spec.Name = ident
+	if spec.Path, ok = imp[1].(string); !ok {
+		p.error(inner, fmt.Sprintf("%v path is not a string", noun))
+		return nil
+	}
+	if !ValidImportPath(spec.Path) {
+		p.error(inner, fmt.Sprintf("invalid %v path: %v", noun, spec.Path))
+		return nil
+	}
+	if len(imp) == 3 {
+		if spec.Doc, ok = imp[2].(string); !ok {
+			p.error(inner, fmt.Sprintf("%v comment is not a string", noun))
+		}
+	}
+	return spec
+}
+
+// Fields builds the nodes for the entries of a parameter or result list.
+// Only parameter lists may have a final variadic entry, if variadic is
+// true. Invalid entries are omitted.
+func (p *Parser) Fields(form *list.Pair, variadic bool) (fields []*Field) {
+	if !list.IsProper(form) {
+		p.error(form, "invalid parameter list")
+		return nil
+	}
+	for entries := form; entries != list.Nil(); entries = entries.Cdr.(*list.Pair) {
+		entryForm, ok := entries.Car.(*list.Pair)
+		if !ok || entryForm == nil || !list.IsProper(entryForm) {
+			p.error(form, "invalid parameter list entry")
+			continue
+		}
+		entry := entryForm.ToSlice()
+		if len(entry) < 2 || len(entry) > 3 || (!variadic && len(entry) != 2) {
+			p.error(entryForm, "invalid parameter declaration length")
+			continue
+		}
+		names := Symbols(entry[0])
+		if len(names) == 0 {
+			p.error(entryForm, fmt.Sprintf("invalid parameter names %v", entry[0]))
+			continue
+		}
+		for _, name := range names {
+			if !ValidSimpleIdentifier(name) {
+				p.error(entryForm, fmt.Sprintf("invalid identifier %v", name))
+			}
+		}
+		field := &Field{Span: p.span(entryForm), Names: names, Type: entry[len(entry)-1]}
+		if variadic && entry[1] == _ellipsis {
+			if len(entry) != 3 {
+				p.error(entryForm, "invalid parameter type")
+				continue
+			}
+			if entries.Cdr != list.Nil() {
+				p.error(entryForm, "variadic parameter is not the final entry in parameter list")
+			}
+			field.Variadic = true
+		} else if len(entry) == 3 {
+			p.error(entryForm, "invalid parameter type")
+			continue
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// FuncDecl builds the node for a function or method declaration. It
+// returns nil if the declaration is invalid.
+func (p *Parser) FuncDecl(form *list.Pair) *FuncDecl {
+	if !list.IsProper(form) || form.Cdr == list.Nil() {
+		p.error(form, "invalid function declaration")
+		return nil
+	}
+	decl := &FuncDecl{Span: p.span(form), Body: list.Nil()}
+	rest := form.Cdr.(*list.Pair)
+	if recv, ok := rest.Car.(*list.Pair); ok {
+		decl.Recv = p.Fields(recv, false)
+		if decl.Recv == nil {
+			decl.Recv = []*Field{}
+		}
+		rest = rest.Cdr.(*list.Pair)
+	}
+	if rest == list.Nil() {
+		p.error(form, "function name is not an identifier")
+		return nil
+	}
+	ident, ok := rest.Car.(*lib.Symbol)
+	if !ok {
+		p.error(form, "function name is not an identifier")
+		return nil
+	}
+	if !ValidSimpleIdentifier(ident) || ident.Identifier == "_" {
+		p.error(form, "invalid function name")
+		return nil
+	}
+	decl.Name = ident
+	rest = rest.Cdr.(*list.Pair)
+	if rest == list.Nil() {
+		return decl
+	}
+	params, ok := rest.Car.(*list.Pair)
+	if !ok {
+		p.error(form, "missing parameter list in function declaration")
+		return nil
+	}
+	decl.Params = p.Fields(params, true)
+	rest = rest.Cdr.(*list.Pair)
+	if rest == list.Nil() {
+		return decl
+	}
+	results, ok := rest.Car.(*list.Pair)
+	if !ok {
+		p.error(form, "missing result list in function declaration")
+		return nil
+	}
+	decl.Results = p.Fields(results, false)
+	rest = rest.Cdr.(*list.Pair)
+	if rest == list.Nil() {
+		// An empty result list at the end implies a body, so that
+		// (func f () ()) declares a function with an empty body.
+		decl.HasBody = results == list.Nil()
+		return decl
+	}
+	if comment, ok := rest.Car.(string); ok {
+		decl.Doc = comment
+		rest = rest.Cdr.(*list.Pair)
+	}
+	// A doc string alone is not a body, as in external declarations.
+	decl.HasBody = rest != list.Nil()
+	decl.Body = rest
+	return decl
+}
@@ -0,0 +1,146 @@
+package ast_test
+
+import (
+	"testing"
+
+	"github.com/pcostanza/slick/ast"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+func parse(t *testing.T, src string) (*ast.Parser, *list.Pair, *reader.Reader) {
+	t.Helper()
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, ok := rd.Read().(*list.Pair)
+	if !ok || form == nil {
+		t.Fatalf("%s is not a list", src)
+	}
+	return ast.NewParser(rd), form, rd
+}
+
+func TestPackageClause(t *testing.T) {
+	p, form, rd := parse(t, `(package example "Package example." :external-test)`)
+	pkg := p.PackageClause(form)
+	if err := rd.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name.Identifier != "example" || pkg.Doc != "Package example." || !pkg.ExternalTest {
+		t.Errorf("unexpected package clause %+v", pkg)
+	}
+	if !pkg.Pos().IsValid() || pkg.End() <= pkg.Pos() {
+		t.Errorf("invalid package clause span %v-%v", pkg.Pos(), pkg.End())
+	}
+}
+
+func TestImportSpec(t *testing.T) {
+	p, form, rd := parse(t, `(import "fmt" (s "strings" :when "linux") (quote (u "unsafe")))`)
+	var specs []*ast.ImportSpec
+	for _, element := range form.Cdr.(*list.Pair).ToSlice() {
+		specs = append(specs, p.ImportSpec(form, element, false))
+	}
+	if err := rd.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if specs[0].Name != nil || specs[0].Path != "fmt" || specs[0].Form() != form {
+		t.Errorf("unexpected import spec %+v", specs[0])
+	}
+	if specs[1].Name.Identifier != "s" || specs[1].Path != "strings" || specs[1].Condition != "linux" {
+		t.Errorf("unexpected import spec %+v", specs[1])
+	}
+	if specs[2].Name.Identifier != "u" || !specs[2].Quoted {
+		t.Errorf("unexpected import spec %+v", specs[2])
+	}
+}
+
+func TestFuncDecl(t *testing.T) {
+	p, form, rd := parse(t, `(func (((p q) *Point)) Scale ((f float64) (xs ... int)) ((_ int)) "Scale scales p." (return 0))`)
+	scale := p.FuncDecl(form)
+	if err := rd.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if scale.Name.Identifier != "Scale" || scale.Doc != "Scale scales p." || !scale.HasBody {
+		t.Errorf("unexpected function declaration %+v", scale)
+	}
+	if len(scale.Recv) != 1 || len(scale.Recv[0].Names) != 2 {
+		t.Errorf("unexpected receiver %+v", scale.Recv)
+	}
+	if len(scale.Params) != 2 || scale.Params[0].Variadic || !scale.Params[1].Variadic {
+		t.Errorf("unexpected parameters %+v", scale.Params)
+	}
+	if len(scale.Results) != 1 || scale.Body.Length() != 1 {
+		t.Errorf("unexpected results %+v or body %v", scale.Results, scale.Body)
+	}
+}
+
+func TestFuncBodies(t *testing.T) {
+	for src, hasBody := range map[string]bool{
+		`(func f)`:                         false,
+		`(func f ((x int)))`:               false,
+		`(func f () ())`:                   true,
+		`(func f () () (print 1))`:         true,
+		`(func f () () "Doc.")`:            false,
+		`(func f () () "Doc." (print 1))`:  true,
+		`(func f () ((y int)))`:            false,
+		`(func f () ((y int)) "Doc.")`:     false,
+		`(func f () ((y int)) (return 1))`: true,
+	} {
+		p, form, rd := parse(t, src)
+		decl := p.FuncDecl(form)
+		if err := rd.Errors.Err(); err != nil {
+			t.Errorf("unexpected error %v for %s", err, src)
+			continue
+		}
+		if decl.HasBody != hasBody {
+			t.Errorf("%s has body: %v, expected %v", src, decl.HasBody, hasBody)
+		}
+		if !decl.HasBody && decl.Body != nil {
+			t.Errorf("%s has statements %v without body", src, decl.Body)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		`(package)`,
+		`(package _)`,
+		`(import (f 42))`,
+		`(import (f "fmt" :when 1))`,
+		`(func f ((x ... int) (y int)))`,
+		`(func f ((x ... int)) ((y ... int)))`,
+		`(func f ((x)))`,
+		`(func 42 ())`,
+	} {
+		p, form, rd := parse(t, src)
+		switch form.Car.(*lib.Symbol).Identifier {
+		case "package":
+			p.PackageClause(form)
+		case "import":
+			for _, element := range form.Cdr.(*list.Pair).ToSlice() {
+				p.ImportSpec(form, element, false)
+			}
+		default:
+			p.FuncDecl(form)
+		}
+		if rd.Errors.Err() == nil {
+			t.Errorf("no error for %s", src)
+		}
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	for lit, valid := range map[string]bool{"x": true, "_x1": true, "1x": false, "": false, "a-b": false, "ä": true} {
+		if ast.ValidGoIdentifier(lit) != valid {
+			t.Errorf("ValidGoIdentifier(%q) is not %v", lit, valid)
+		}
+	}
+	_, form, _ := parse(t, `((a b) (a 1) () c 42)`)
+	for i, x := range form.ToSlice() {
+		if syms := ast.Symbols(x); len(syms) != []int{2, 0, 0, 1, 0}[i] {
+			t.Errorf("Symbols(%v) = %v", x, syms)
+		}
+	}
+}
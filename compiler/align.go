@@ -0,0 +1,74 @@
+package compiler
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+When lines are aligned, see Config.AlignLines, the compiler marks the start of each statement
+and top-level declaration that is read from the source file with the
+line of its form. When the file is written, the marks are removed, and
+blank lines are inserted before marked code that would otherwise start
+on an earlier line than its form. Code cannot be moved up, so alignment
+is only possible where the source file has at least as many lines as
+the generated code before a form, for example because of comments or
+statements that span several lines. Statements that result from macro
+expansions are not marked, and follow the code before them.
+*/
+
+// lineMark delimits line marks in the generated code. The generated code
+// contains no NUL bytes otherwise: Literals are quoted, and NUL bytes in
+// comments are escaped, see formatComment. A NUL byte that is not part of
+// a well-formed line mark is nevertheless written unchanged.
+const lineMark = 0
+
+// markLine marks the start of the code for form with the line of form.
+func (cmp *compiler) markLine(result []byte, form *list.Pair) []byte {
+	if !cmp.config.AlignLines {
+		return result
+	}
+	pos, _ := cmp.reader.FormPos(form)
+	if !pos.IsValid() {
+		return result
+	}
+	result = append(result, lineMark)
+	result = strconv.AppendInt(result, int64(cmp.reader.File().Line(pos)), 10)
+	return append(result, lineMark)
+}
+
+// A lineAligner writes generated code, replacing line marks with padding.
+type lineAligner struct {
+	w    io.Writer
+	line int
+}
+
+func (a *lineAligner) write(buf []byte) error {
+	var out []byte
+	for {
+		i := bytes.IndexByte(buf, lineMark)
+		if i < 0 {
+			break
+		}
+		out = append(out, buf[:i]...)
+		a.line += bytes.Count(buf[:i], []byte{'\n'})
+		j := i + 1 + bytes.IndexByte(buf[i+1:], lineMark)
+		line, err := strconv.Atoi(string(buf[i+1 : j]))
+		if j == i || err != nil {
+			out = append(out, lineMark)
+			buf = buf[i+1:]
+			continue
+		}
+		for ; a.line < line; a.line++ {
+			out = append(out, '\n')
+		}
+		buf = buf[j+1:]
+	}
+	out = append(out, buf...)
+	a.line += bytes.Count(buf, []byte{'\n'})
+	_, err := a.w.Write(out)
+	return err
+}
@@ -0,0 +1,138 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Both sides of an assignment and the right-hand side of a short variable
+declaration are either a single expression or a values form. The number
+of variables is checked against the number of values where the compiler
+knows it: A values form yields one value per expression, an index
+expression, a type assertion, or a receive operation yields one value,
+or two when the second value reports success, and any other expression
+except a call yields a single value. The number of results of calls is
+not known to the compiler, and left to the Go compiler to check.
+*/
+
+// assignmentValues returns the expressions of one side of an assignment,
+// after expanding macros and splicing.
+func (cmp *compiler) assignmentValues(form *list.Pair, side interface{}) ([]interface{}, bool) {
+	values := cmp.spliceExpressions(form, []interface{}{side})
+	if len(values) == 1 {
+		if e, ok := values[0].(*list.Pair); ok && e != nil && e.Car == _values {
+			if !list.IsProper(e) {
+				cmp.error(form, fmt.Sprintf("invalid values expression %v", e))
+				return nil, false
+			}
+			values = cmp.spliceExpressions(e, e.Cdr.(*list.Pair).ToSlice())
+		}
+	}
+	if len(values) == 0 {
+		cmp.error(form, "invalid values expression")
+		return nil, false
+	}
+	return values, true
+}
+
+// commaOk reports whether expr is an index expression, a type assertion,
+// or a receive operation, which may yield an additional boolean value.
+func commaOk(expr *list.Pair) bool {
+	switch expr.Car {
+	case _at, _assert:
+		return true
+	case _arrow_left:
+		return expr.Length() == 2
+	}
+	return false
+}
+
+// singleValued reports whether expr is known to yield a single value.
+func singleValued(expr interface{}) bool {
+	e, ok := expr.(*list.Pair)
+	if !ok || e == nil {
+		return true
+	}
+	switch e.Car {
+	case _make, _make_struct, _make_array, _make_slice, _make_map, _func, _slot, _slice, _convert, _if_expr,
+		_quote, _quasiquote,
+		_plus, _minus, _mul, _div, _rem, _bang, _xor, _and, _and_not, _or, _shl, _shr,
+		_bool_and, _bool_or, _equal_equal, _not_equal, _less, _less_equal, _greater, _greater_equal:
+		return true
+	}
+	return false
+}
+
+// checkAssignment reports an error if the number of variables does not
+// match the number of values, as far as it is known.
+func (cmp *compiler) checkAssignment(form *list.Pair, variables int, values []interface{}) bool {
+	if len(values) > 1 {
+		if variables != len(values) {
+			cmp.error(form, fmt.Sprintf("assignment mismatch: %v variables but %v values", variables, len(values)))
+			return false
+		}
+		return true
+	}
+	if variables == 1 {
+		return true
+	}
+	if e, ok := values[0].(*list.Pair); ok && e != nil && commaOk(e) {
+		if variables != 2 {
+			cmp.error(form, fmt.Sprintf("assignment mismatch: %v variables but %v yields 1 or 2 values", variables, e.Car))
+			return false
+		}
+		return true
+	}
+	if singleValued(values[0]) {
+		cmp.error(form, fmt.Sprintf("assignment mismatch: %v variables but 1 value", variables))
+		return false
+	}
+	return true
+}
+
+func (cmp *compiler) compileExpressionList(result []byte, form *list.Pair, exprs []interface{}) []byte {
+	result = cmp.compileExpression(result, form, exprs[0])
+	for _, expr := range exprs[1:] {
+		result = append(result, ',', ' ')
+		result = cmp.compileExpression(result, form, expr)
+	}
+	return result
+}
+
+func (cmp *compiler) compileAssignment(result []byte, form *list.Pair, lhs, rhs interface{}) []byte {
+	variables, ok := cmp.assignmentValues(form, lhs)
+	if !ok {
+		return result
+	}
+	values, ok := cmp.assignmentValues(form, rhs)
+	if !ok || !cmp.checkAssignment(form, len(variables), values) {
+		return result
+	}
+	result = cmp.compileExpressionList(result, form, variables)
+	result = append(result, " = "...)
+	return cmp.compileExpressionList(result, form, values)
+}
+
+func (cmp *compiler) compileShortVariableDeclaration(result []byte, form *list.Pair, names []*lib.Symbol, rhs interface{}) []byte {
+	values, ok := cmp.assignmentValues(form, rhs)
+	if !ok || !cmp.checkAssignment(form, len(names), values) {
+		return result
+	}
+	result = append(result, names[0].Identifier...)
+	for _, name := range names[1:] {
+		result = append(result, ',', ' ')
+		result = append(result, name.Identifier...)
+	}
+	if len(names) == len(values) {
+		for i, name := range names {
+			cmp.declareVariable(name, inferChannelType(values[i]))
+		}
+	} else {
+		cmp.declareVariables(names)
+	}
+	result = append(result, " := "...)
+	return cmp.compileExpressionList(result, form, values)
+}
@@ -0,0 +1,265 @@
+package compiler
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+The macro cache memoizes macro expansions within a file, and across
+the files and repeated compilations that share a MacroCache. An entry
+is keyed on the content hash of the plugin binary that provides the
+macro, the name of the macro, and a structural hash of the macro
+invocation form.
+
+Only expansions that are pure as far as the compiler can tell are
+cached: An expansion that fails, that generates fresh symbols via
+lib.Gensym, or that has effects on the environment, such as requiring
+imports or emitting top-level declarations, is recomputed every time,
+since reusing it would either hide the error, reuse identifiers that
+are supposed to be unique, or lose the effects.
+
+Plugin binaries are identified by their size and modification time.
+When either changes, the binary is hashed again, so entries that belong
+to the previous version are no longer found. The number of entries is
+bounded, and the oldest entries are evicted first, so that stale entries
+eventually disappear and a long-running process, for example in watch
+mode, does not grow without limit.
+*/
+
+type (
+	digest = [sha256.Size]byte
+
+	macroKey struct {
+		plugin digest
+		name   string
+		form   digest
+	}
+
+	pluginStamp struct {
+		size    int64
+		modTime time.Time
+		hash    digest
+	}
+
+	// A MacroCache memoizes macro expansions across compilations, see
+	// Config.Cache. The zero MacroCache holds up to DefaultMacroCacheSize
+	// expansions.
+	MacroCache struct {
+		sync.Mutex
+		size    int
+		entries map[macroKey]interface{}
+		order   []macroKey // ring of keys in the order of insertion
+		next    int
+	}
+)
+
+// DefaultMacroCacheSize is the number of expansions that a macro cache
+// holds by default.
+const DefaultMacroCacheSize = 10000
+
+// NewMacroCache returns a macro cache that holds up to size expansions.
+// If size is zero, it holds up to DefaultMacroCacheSize expansions.
+func NewMacroCache(size int) *MacroCache {
+	return &MacroCache{size: size}
+}
+
+// add adds an entry, evicting the oldest one if the cache is full.
+func (c *MacroCache) add(key macroKey, newForm interface{}) {
+	if c.entries == nil {
+		c.entries = make(map[macroKey]interface{})
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	size := c.size
+	if size <= 0 {
+		size = DefaultMacroCacheSize
+	}
+	if len(c.order) < size {
+		c.order = append(c.order, key)
+	} else {
+		delete(c.entries, c.order[c.next])
+		c.order[c.next] = key
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.entries[key] = newForm
+}
+
+// pluginHashes memoizes the content hashes of plugin binaries. It is
+// shared by all macro caches, so that a plugin is only hashed again
+// when it changes.
+var pluginHashes = struct {
+	sync.Mutex
+	stamps map[string]pluginStamp
+}{stamps: make(map[string]pluginStamp)}
+
+func pluginHash(file string) (digest, bool) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return digest{}, false
+	}
+	pluginHashes.Lock()
+	stamp, ok := pluginHashes.stamps[file]
+	pluginHashes.Unlock()
+	if ok && stamp.size == info.Size() && stamp.modTime.Equal(info.ModTime()) {
+		return stamp.hash, true
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return digest{}, false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return digest{}, false
+	}
+	stamp = pluginStamp{size: info.Size(), modTime: info.ModTime()}
+	h.Sum(stamp.hash[:0])
+	pluginHashes.Lock()
+	pluginHashes.stamps[file] = stamp
+	pluginHashes.Unlock()
+	return stamp.hash, true
+}
+
+func (c *MacroCache) expand(env Environment, file, name string, fn macro, form *list.Pair) (interface{}, error) {
+	pluginHash, ok := pluginHash(file)
+	if !ok {
+		return fn(form, env)
+	}
+	formHash, ok := hashForm(form)
+	if !ok {
+		return fn(form, env)
+	}
+	key := macroKey{plugin: pluginHash, name: name, form: formHash}
+	c.Lock()
+	newForm, ok := c.entries[key]
+	c.Unlock()
+	if ok {
+		return newForm, nil
+	}
+	counter, effects := lib.GensymCounter(), env.cmp.effects
+	newForm, err := fn(form, env)
+	if err == nil && lib.GensymCounter() == counter && env.cmp.effects == effects {
+		c.Lock()
+		c.add(key, newForm)
+		c.Unlock()
+	}
+	return newForm, err
+}
+
+const (
+	tagNil byte = iota
+	tagPair
+	tagSymbol
+	tagInt
+	tagFloat
+	tagComplex
+	tagRune
+	tagString
+	tagBool
+	tagGoInt
+	tagNilValue
+	tagRef
+)
+
+// hashForm computes a structural hash of form. Two forms that are
+// equal element by element have the same hash, no matter whether they
+// share structure or not. The result is false if form contains values
+// that the reader cannot produce, such as bad forms or circular lists.
+func hashForm(form interface{}) (result digest, ok bool) {
+	h := sha256.New()
+	if !writeForm(h, form, make(map[*list.Pair]bool)) {
+		return
+	}
+	h.Sum(result[:0])
+	return result, true
+}
+
+func writeString(h hash.Hash, s string) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+	io.WriteString(h, s)
+}
+
+func writeUint(h hash.Hash, tag byte, x uint64) {
+	var buf [9]byte
+	buf[0] = tag
+	binary.LittleEndian.PutUint64(buf[1:], x)
+	h.Write(buf[:])
+}
+
+// writeForm keeps track of the pairs on the current path in active, so
+// that it rejects circular forms, but accepts shared substructure.
+func writeForm(h hash.Hash, form interface{}, active map[*list.Pair]bool) bool {
+	var spine []*list.Pair
+	defer func() {
+		for _, p := range spine {
+			delete(active, p)
+		}
+	}()
+	for {
+		switch f := form.(type) {
+		case *list.Pair:
+			if f == nil {
+				h.Write([]byte{tagNil})
+				return true
+			}
+			if active[f] {
+				return false
+			}
+			active[f] = true
+			spine = append(spine, f)
+			h.Write([]byte{tagPair})
+			if !writeForm(h, f.Car, active) {
+				return false
+			}
+			form = f.Cdr
+		case *lib.Symbol:
+			h.Write([]byte{tagSymbol})
+			writeString(h, f.Package)
+			writeString(h, f.Identifier)
+			return true
+		case *big.Int:
+			h.Write([]byte{tagInt})
+			writeString(h, f.String())
+			return true
+		case float64:
+			writeUint(h, tagFloat, math.Float64bits(f))
+			return true
+		case complex128:
+			writeUint(h, tagComplex, math.Float64bits(real(f)))
+			writeUint(h, tagComplex, math.Float64bits(imag(f)))
+			return true
+		case rune:
+			writeUint(h, tagRune, uint64(f))
+			return true
+		case int:
+			writeUint(h, tagGoInt, uint64(f))
+			return true
+		case string:
+			h.Write([]byte{tagString})
+			writeString(h, f)
+			return true
+		case bool:
+			if f {
+				writeUint(h, tagBool, 1)
+			} else {
+				writeUint(h, tagBool, 0)
+			}
+			return true
+		default:
+			return false
+		}
+	}
+}
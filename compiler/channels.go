@@ -0,0 +1,179 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/pcostanza/slick/ast"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+The compiler keeps track of the channel types of the variables that are
+declared within a top-level declaration, so that sends and receives on
+channels with the wrong direction are reported in terms of Slick forms.
+Variables that are declared more than once within the same top-level
+declaration are not tracked, because the compiler does not resolve
+scopes.
+*/
+
+// channelType returns chan, chan<- or <-chan if typ is a channel type.
+func channelType(typ interface{}) *lib.Symbol {
+	if t, ok := typ.(*list.Pair); ok && t != nil {
+		switch t.Car {
+		case _chan, _chan_right, _chan_left:
+			return t.Car.(*lib.Symbol)
+		}
+	}
+	return nil
+}
+
+// inferChannelType returns the channel type of expr, as far as it can be
+// determined without type checking.
+func inferChannelType(expr interface{}) *lib.Symbol {
+	e, ok := expr.(*list.Pair)
+	if !ok || e == nil || !list.IsProper(e) {
+		return nil
+	}
+	switch e.Car {
+	case _make:
+		return channelType(list.Cadr(e))
+	case _convert:
+		if e.Length() == 3 {
+			return channelType(list.Caddr(e))
+		}
+	}
+	return nil
+}
+
+// declareVariable records the channel type of a variable declaration,
+// or nil if the type is not a channel type or not known.
+func (cmp *compiler) declareVariable(name *lib.Symbol, chanType *lib.Symbol) {
+	if name.Identifier == "_" {
+		return
+	}
+	if cmp.channels == nil {
+		cmp.channels = make(map[*lib.Symbol]*lib.Symbol)
+	}
+	if _, ok := cmp.channels[name]; ok {
+		cmp.channels[name] = nil
+		return
+	}
+	cmp.channels[name] = chanType
+}
+
+// declareVariables records variables that are declared without a known
+// type, like in short variable declarations.
+func (cmp *compiler) declareVariables(names []*lib.Symbol) {
+	for _, name := range names {
+		cmp.declareVariable(name, nil)
+	}
+}
+
+// declareParameters records the channel types of function parameters.
+func (cmp *compiler) declareParameters(fields []*ast.Field) {
+	for _, field := range fields {
+		var typ *lib.Symbol
+		if !field.Variadic {
+			typ = channelType(field.Type)
+		}
+		for _, name := range field.Names {
+			cmp.declareVariable(name, typ)
+		}
+	}
+}
+
+// checkSend reports an error if ch is known to be a receive-only channel.
+func (cmp *compiler) checkSend(form *list.Pair, ch interface{}) {
+	if sym, ok := ch.(*lib.Symbol); ok && cmp.channels[sym] == _chan_left {
+		cmp.error(form, fmt.Sprintf("invalid send to receive-only channel %v of type %v", sym, _chan_left))
+	}
+}
+
+// checkReceive reports an error if ch is known to be a send-only channel.
+func (cmp *compiler) checkReceive(form *list.Pair, ch interface{}) {
+	if sym, ok := ch.(*lib.Symbol); ok && cmp.channels[sym] == _chan_right {
+		cmp.error(form, fmt.Sprintf("invalid receive from send-only channel %v of type %v", sym, _chan_right))
+	}
+}
+
+// receiveOperand returns the channel operand of expr if it is a receive
+// operation.
+func receiveOperand(expr interface{}) (interface{}, bool) {
+	if e, ok := expr.(*list.Pair); ok && e != nil && e.Car == _arrow_left && list.IsProper(e) && e.Length() == 2 {
+		return list.Cadr(e), true
+	}
+	return nil, false
+}
+
+// compileCommCase compiles the send or receive statement of a case of a
+// select statement.
+func (cmp *compiler) compileCommCase(result []byte, form *list.Pair, head interface{}) []byte {
+	stmt, ok := head.(*list.Pair)
+	if !ok || stmt == nil || !list.IsProper(stmt) {
+		cmp.error(form, fmt.Sprintf("select case %v is not a send or receive statement", head))
+		return result
+	}
+	s := stmt.ToSlice()
+	switch s[0] {
+	case _arrow_right:
+		if len(s) != 3 {
+			cmp.error(stmt, fmt.Sprintf("invalid send statement %v in select case", stmt))
+			return result
+		}
+		cmp.checkSend(stmt, s[1])
+		result = cmp.compileExpression(result, stmt, s[1])
+		result = append(result, ' ', '<', '-', ' ')
+		return cmp.compileExpression(result, stmt, s[2])
+	case _arrow_left:
+		ch, ok := receiveOperand(stmt)
+		if !ok {
+			cmp.error(stmt, fmt.Sprintf("invalid receive operation %v in select case", stmt))
+			return result
+		}
+		cmp.checkReceive(stmt, ch)
+		result = append(result, '<', '-')
+		return cmp.compileExpression(result, stmt, ch)
+	case _equal, _colon_equal:
+		if len(s) != 3 {
+			cmp.error(stmt, fmt.Sprintf("invalid receive statement %v in select case", stmt))
+			return result
+		}
+		ch, ok := receiveOperand(s[2])
+		if !ok {
+			cmp.error(stmt, fmt.Sprintf("select case %v does not receive from a channel", stmt))
+			return result
+		}
+		cmp.checkReceive(stmt, ch)
+		if s[0] == _colon_equal {
+			names := ast.Symbols(s[1])
+			if len(names) < 1 || len(names) > 2 {
+				cmp.error(stmt, fmt.Sprintf("receive statement %v in select case must declare one or two variables", stmt))
+				return result
+			}
+			for _, name := range names {
+				if !ast.ValidSimpleIdentifier(name) {
+					cmp.error(stmt, fmt.Sprintf("invalid identifier %v", name))
+				}
+			}
+			cmp.declareVariables(names)
+			result = append(result, names[0].Identifier...)
+			for _, name := range names[1:] {
+				result = append(result, ',', ' ')
+				result = append(result, name.Identifier...)
+			}
+			result = append(result, " := <-"...)
+		} else {
+			if lhs, ok := s[1].(*list.Pair); ok && lhs != nil && lhs.Car == _values && (!list.IsProper(lhs) || lhs.Length() > 3) {
+				cmp.error(stmt, fmt.Sprintf("receive statement %v in select case must assign one or two values", stmt))
+				return result
+			}
+			result = cmp.compileExpression(result, stmt, s[1])
+			result = append(result, " = <-"...)
+		}
+		return cmp.compileExpression(result, stmt, ch)
+	default:
+		cmp.error(stmt, fmt.Sprintf("select case %v is not a send or receive statement", stmt))
+		return result
+	}
+}
@@ -0,0 +1,328 @@
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Forms are exchanged with plugin host processes in a simple binary
+encoding that uses the same tags as the structural hashing of forms.
+
+Pairs are numbered in the order in which they are written or read
+during a macro call, and a pair that has already been exchanged during
+the same call is encoded as a reference to its number. This preserves
+shared structure, and more importantly allows the compiler to map the
+subforms that a macro returns, or reports diagnostics for, back to the
+original forms along with their source positions.
+*/
+
+type formTable struct {
+	index map[*list.Pair]int
+	pairs []*list.Pair
+}
+
+func newFormTable() *formTable {
+	return &formTable{index: make(map[*list.Pair]int)}
+}
+
+func (t *formTable) add(p *list.Pair) {
+	t.index[p] = len(t.pairs)
+	t.pairs = append(t.pairs, p)
+}
+
+func (t *formTable) truncate(n int) {
+	for _, p := range t.pairs[n:] {
+		delete(t.index, p)
+	}
+	t.pairs = t.pairs[:n]
+}
+
+// A hostConn is one end of the connection between the compiler and a
+// plugin host process. Messages are assembled in buf and only written
+// by flush. Read errors are sticky: After the first one, all further
+// reads return zero values, and err reports the error.
+type hostConn struct {
+	r     *bufio.Reader
+	w     io.Writer
+	buf   bytes.Buffer
+	forms *formTable
+	err   error
+}
+
+func newHostConn(r io.Reader, w io.Writer) *hostConn {
+	return &hostConn{r: bufio.NewReader(r), w: w, forms: newFormTable()}
+}
+
+func (c *hostConn) flush() error {
+	_, err := c.w.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+func (c *hostConn) writeByte(b byte) {
+	c.buf.WriteByte(b)
+}
+
+func (c *hostConn) writeUvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	c.buf.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func (c *hostConn) writeVarint(x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	c.buf.Write(buf[:binary.PutVarint(buf[:], x)])
+}
+
+func (c *hostConn) writeUint64(x uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], x)
+	c.buf.Write(buf[:])
+}
+
+func (c *hostConn) writeString(s string) {
+	c.writeUvarint(uint64(len(s)))
+	c.buf.WriteString(s)
+}
+
+func (c *hostConn) writeError(err error) {
+	if err == nil {
+		c.writeString("")
+		return
+	}
+	msg := err.Error()
+	if msg == "" {
+		msg = "unknown error"
+	}
+	c.writeString(msg)
+}
+
+// writeForm writes form, or nil if form contains values that cannot be
+// exchanged with a plugin host, in which case it also returns an error.
+func (c *hostConn) writeForm(form interface{}) error {
+	mark, n := c.buf.Len(), len(c.forms.pairs)
+	if err := c.encodeForm(form); err != nil {
+		c.buf.Truncate(mark)
+		c.forms.truncate(n)
+		c.writeByte(tagNilValue)
+		return err
+	}
+	return nil
+}
+
+func (c *hostConn) encodeForm(form interface{}) error {
+	for {
+		switch f := form.(type) {
+		case *list.Pair:
+			if f == nil {
+				c.writeByte(tagNil)
+				return nil
+			}
+			if index, ok := c.forms.index[f]; ok {
+				c.writeByte(tagRef)
+				c.writeUvarint(uint64(index))
+				return nil
+			}
+			c.forms.add(f)
+			c.writeByte(tagPair)
+			if err := c.encodeForm(f.Car); err != nil {
+				return err
+			}
+			form = f.Cdr
+		case *lib.Symbol:
+			c.writeByte(tagSymbol)
+			c.writeString(f.Package)
+			c.writeString(f.Identifier)
+			return nil
+		case *big.Int:
+			c.writeByte(tagInt)
+			c.writeString(f.String())
+			return nil
+		case float64:
+			c.writeByte(tagFloat)
+			c.writeUint64(math.Float64bits(f))
+			return nil
+		case complex128:
+			c.writeByte(tagComplex)
+			c.writeUint64(math.Float64bits(real(f)))
+			c.writeUint64(math.Float64bits(imag(f)))
+			return nil
+		case rune:
+			c.writeByte(tagRune)
+			c.writeVarint(int64(f))
+			return nil
+		case int:
+			c.writeByte(tagGoInt)
+			c.writeVarint(int64(f))
+			return nil
+		case string:
+			c.writeByte(tagString)
+			c.writeString(f)
+			return nil
+		case bool:
+			c.writeByte(tagBool)
+			if f {
+				c.writeByte(1)
+			} else {
+				c.writeByte(0)
+			}
+			return nil
+		case nil:
+			c.writeByte(tagNilValue)
+			return nil
+		default:
+			return fmt.Errorf("value %v of type %T cannot be exchanged with a plugin host", f, f)
+		}
+	}
+}
+
+func (c *hostConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *hostConn) readByte() byte {
+	if c.err != nil {
+		return 0
+	}
+	b, err := c.r.ReadByte()
+	if err != nil {
+		c.fail(err)
+	}
+	return b
+}
+
+func (c *hostConn) readUvarint() uint64 {
+	if c.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		c.fail(err)
+	}
+	return x
+}
+
+func (c *hostConn) readVarint() int64 {
+	if c.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(c.r)
+	if err != nil {
+		c.fail(err)
+	}
+	return x
+}
+
+func (c *hostConn) readUint64() uint64 {
+	var buf [8]byte
+	if c.err != nil {
+		return 0
+	}
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+		c.fail(err)
+		return 0
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+func (c *hostConn) readString() string {
+	n := c.readUvarint()
+	if c.err != nil {
+		return ""
+	}
+	if n > 1<<30 {
+		c.fail(errors.New("string too long"))
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.fail(err)
+		return ""
+	}
+	return string(buf)
+}
+
+func (c *hostConn) readError() error {
+	if msg := c.readString(); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func (c *hostConn) readForm() interface{} {
+	return c.decodeForm(c.readByte())
+}
+
+func (c *hostConn) decodeForm(tag byte) interface{} {
+	if c.err != nil {
+		return nil
+	}
+	switch tag {
+	case tagNil:
+		return list.Nil()
+	case tagRef:
+		index := c.readUvarint()
+		if index >= uint64(len(c.forms.pairs)) {
+			c.fail(fmt.Errorf("invalid form reference %v", index))
+			return nil
+		}
+		return c.forms.pairs[index]
+	case tagPair:
+		first := &list.Pair{}
+		c.forms.add(first)
+		first.Car = c.readForm()
+		last := first
+		for tag = c.readByte(); tag == tagPair && c.err == nil; tag = c.readByte() {
+			next := &list.Pair{}
+			c.forms.add(next)
+			next.Car = c.readForm()
+			last.Cdr = next
+			last = next
+		}
+		last.Cdr = c.decodeForm(tag)
+		return first
+	case tagSymbol:
+		pkg := c.readString()
+		return lib.Intern(pkg, c.readString())
+	case tagInt:
+		s := c.readString()
+		if c.err != nil {
+			return nil
+		}
+		var result big.Int
+		if _, ok := result.SetString(s, 10); !ok {
+			c.fail(fmt.Errorf("invalid integer %v", s))
+			return nil
+		}
+		return &result
+	case tagFloat:
+		return math.Float64frombits(c.readUint64())
+	case tagComplex:
+		re := math.Float64frombits(c.readUint64())
+		return complex(re, math.Float64frombits(c.readUint64()))
+	case tagRune:
+		return rune(c.readVarint())
+	case tagGoInt:
+		return int(c.readVarint())
+	case tagString:
+		return c.readString()
+	case tagBool:
+		return c.readByte() != 0
+	case tagNilValue:
+		return nil
+	default:
+		c.fail(fmt.Errorf("invalid form tag %v", tag))
+		return nil
+	}
+}
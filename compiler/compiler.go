@@ -1,17 +1,17 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
+	"go/token"
 	"io"
 	"math/big"
-	"os"
 	"path"
-	"path/filepath"
-	"plugin"
 	"strconv"
 	"strings"
-	"unicode"
+	"sync"
 
+	"github.com/pcostanza/slick/ast"
 	"github.com/pcostanza/slick/lib"
 	"github.com/pcostanza/slick/list"
 	"github.com/pcostanza/slick/reader"
@@ -19,81 +19,127 @@ import (
 
 type (
 	compiler struct {
-		reader *reader.Reader
-		header []byte
-	}
-
-	Environment struct {
+		reader          *reader.Reader
+		parser          *ast.Parser
+		header          []byte
+		imports         []importSpec
+		emitted         []emittedDecl
+		origin          *list.Pair
+		effects         int
+		reports         int
+		expansions      int
+		pool            quotedPool
+		constants       map[*lib.Symbol]interface{}
+		channels        map[*lib.Symbol]*lib.Symbol
+		fallthroughStmt *list.Pair
+		config          Config
+		cache           *MacroCache
+		definitions     map[string]token.Position
+		local           bool
+		quoted          map[string]token.Position
 	}
 
 	macro = func(form *list.Pair, env Environment) (newForm interface{}, err error)
+
+	readerMacros = func(table *reader.Table) error
 )
 
 func (cmp *compiler) init(rd *reader.Reader) {
 	cmp.reader = rd
+	cmp.parser = ast.NewParser(rd)
+	cmp.parser.Error = cmp.error
 }
 
-var slickPath, slickPlugins, slickRoot, libPlugin string
+// loadPlugin loads the plugin file into the compiler process, or into a
+// plugin host process.
+func (config Config) loadPlugin(file string) (macroProvider, error) {
+	if config.UsePluginHosts || config.Macros.Isolated {
+		return openPluginHost(file, config.PluginHostExecutable, config.Macros.Isolated)
+	}
+	p, err := openInProcess(file)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-func init() {
-	slickPath = os.Getenv("SLICKPATH")
-	var err error
-	if slickPath == "" {
-		slickPath, err = os.UserHomeDir()
-		if err != nil {
-			panic(err)
-		}
-		slickPath = filepath.Join(slickPath, "slick")
+// openPlugin opens the plugin file, reporting errors at form.
+func (cmp *compiler) openPlugin(form *list.Pair, file string) (macroProvider, bool) {
+	p, err := cmp.config.loadPlugin(file)
+	if err != nil {
+		cmp.error(form, fmt.Sprintf("cannot open plugin: %v", err))
+		return nil, false
 	}
-	slickPlugins = filepath.Join(slickPath, "plugins")
-	slickRoot = os.Getenv("SLICKROOT")
-	if slickRoot == "" {
-		slickRoot, err = os.UserHomeDir()
-		if err != nil {
-			panic(err)
-		}
-		slickRoot = filepath.Join(slickRoot, "slick")
+	return p, true
+}
+
+func (cmp *compiler) resolvePlugin(form *list.Pair, path string) (macroProvider, bool) {
+	file, ok := cmp.pluginFile(form, path)
+	if !ok {
+		return nil, false
 	}
-	libPlugin = filepath.Join(slickRoot, "plugins", "plugin.so")
+	return cmp.openPlugin(form, file)
 }
 
-func (cmp *compiler) resolvePlugin(path string) *plugin.Plugin {
-	if path[0] == '#' {
-		path = path[1:]
+func (cmp *compiler) installReaderMacros(form *list.Pair, p macroProvider) {
+	install, ok, err := p.lookupReaderMacros()
+	if err == errReaderMacrosInHost {
+		cmp.warning(form, err.Error())
+		return
+	} else if err != nil {
+		cmp.error(form, err.Error())
+		return
 	}
-	fullPath := filepath.Join(slickPlugins, path, "slick/plugin.so")
-	p, err := plugin.Open(fullPath)
-	if err != nil {
-		panic(err)
+	if !ok {
+		return
 	}
-	return p
+	table := reader.CopyTable(cmp.reader.Table())
+	if err := install(table); err != nil {
+		cmp.error(form, fmt.Sprintf("error during reader macro installation: %v", err))
+		return
+	}
+	cmp.reader.SetTable(table)
 }
 
-func (cmp *compiler) resolveLibPlugin() *plugin.Plugin {
-	p, err := plugin.Open(libPlugin)
-	if err != nil {
-		panic(err)
+// usePlugin opens the plugin of a use declaration, checks its manifest,
+// and installs its reader macros.
+func (cmp *compiler) usePlugin(form *list.Pair, path string) {
+	if p, ok := cmp.resolvePlugin(form, path); ok {
+		cmp.checkPluginManifest(form, p)
+		cmp.installReaderMacros(form, p)
 	}
-	return p
 }
 
-func (cmp *compiler) encloseSymbol(sym *lib.Symbol) *lib.Symbol {
+// encloseSymbol returns the qualified identifier for sym in the generated
+// code, and adds an import for its package if necessary. A package that
+// is only imported quoted is imported this way when a macro expansion
+// refers to it, but it is an error when form is read from the source file,
+// because quoted imports may only be referred to in quoted contexts.
+func (cmp *compiler) encloseSymbol(form *list.Pair, sym *lib.Symbol) *lib.Symbol {
 	nsym, enclosed := cmp.reader.EncloseSymbol(sym)
 	if enclosed {
-		cmp.header = append(cmp.header, "import "...)
-		cmp.header = append(cmp.header, nsym.Package...)
-		cmp.header = append(cmp.header, " \""...)
-		cmp.header = append(cmp.header, sym.Package...)
-		cmp.header = append(cmp.header, "\"\n"...)
+		if at, ok := cmp.quoted[sym.Package]; ok {
+			if pos, _ := cmp.reader.FormPos(form); pos.IsValid() {
+				cmp.error(form, fmt.Sprintf("%v of quoted import %q used outside of quoted context, import quoted at %v", sym.Identifier, sym.Package, at))
+			}
+		}
+		cmp.addImport(nsym.Package, sym.Package)
 	}
 	return nsym
 }
 
 type bailout struct{}
 
-func (cmp *compiler) error(form *list.Pair, msg string) {
+func (cmp *compiler) position(form *list.Pair) token.Position {
 	pos, _ := cmp.reader.FormPos(form)
-	epos := cmp.reader.File().Position(pos)
+	if !pos.IsValid() && cmp.origin != nil {
+		pos, _ = cmp.reader.FormPos(cmp.origin)
+	}
+	return cmp.reader.File().Position(pos)
+}
+
+func (cmp *compiler) error(form *list.Pair, msg string) {
+	epos := cmp.position(form)
 	n := len(cmp.reader.Errors)
 	if n > 0 && cmp.reader.Errors[n-1].Pos.Line == epos.Line {
 		return
@@ -105,6 +151,35 @@ func (cmp *compiler) error(form *list.Pair, msg string) {
 	cmp.reader.Errors.Add(epos, msg)
 }
 
+func (cmp *compiler) warning(form *list.Pair, msg string) {
+	cmp.reader.Warnings.Add(cmp.position(form), msg)
+}
+
+// define records the definition of a top-level identifier by form, and
+// reports a redefinition if the identifier is already defined in the
+// file, or in another file of the package in package mode. Declarations
+// in function bodies are not recorded.
+func (cmp *compiler) define(form *list.Pair, ident *lib.Symbol) {
+	if cmp.local || ident.Identifier == "_" {
+		return
+	}
+	pos := cmp.position(form)
+	if previous, ok := cmp.definitions[ident.Identifier]; ok {
+		cmp.error(form, fmt.Sprintf("%v redeclared in this file, previous declaration at %v", ident.Identifier, previous))
+		return
+	}
+	if pkg := cmp.config.Package; pkg != nil {
+		if previous, ok := pkg.define(ident.Identifier, pos); ok {
+			cmp.error(form, fmt.Sprintf("%v redeclared in this package, previous declaration at %v", ident.Identifier, previous))
+			return
+		}
+	}
+	if cmp.definitions == nil {
+		cmp.definitions = make(map[string]token.Position)
+	}
+	cmp.definitions[ident.Identifier] = pos
+}
+
 func in(key *lib.Symbol, keys []*lib.Symbol) bool {
 	for _, skey := range keys {
 		if key == skey {
@@ -116,47 +191,45 @@ func in(key *lib.Symbol, keys []*lib.Symbol) bool {
 
 func (cmp *compiler) checkf(outer, form *list.Pair, keys ...*lib.Symbol) {
 	for form != list.Nil() {
-		if !in(form.Car.(*lib.Symbol), keys) {
+		if key, ok := form.Car.(*lib.Symbol); !ok || !in(key, keys) {
 			cmp.error(outer, fmt.Sprintf("invalid key %v, must be one of %v", form.Car, keys))
 		}
-		form = form.Cdr.(*list.Pair).Cdr.(*list.Pair)
+		next, ok := form.Cdr.(*list.Pair)
+		if !ok || next == list.Nil() {
+			cmp.error(outer, fmt.Sprintf("missing value for key %v", form.Car))
+			return
+		}
+		if form, ok = next.Cdr.(*list.Pair); !ok {
+			cmp.error(outer, "invalid property list")
+			return
+		}
 	}
 }
 
 func getf(form *list.Pair, key *lib.Symbol) (interface{}, bool) {
 	for form != list.Nil() {
+		next, ok := form.Cdr.(*list.Pair)
+		if !ok || next == list.Nil() {
+			return nil, false
+		}
 		if form.Car == key {
-			return form.Cdr.(*list.Pair).Car, true
+			return next.Car, true
 		}
-		form = form.Cdr.(*list.Pair).Cdr.(*list.Pair)
-	}
-	return nil, false
-}
-
-func isValidGoIdentifier(lit string) bool {
-	if len(lit) == 0 {
-		return false
-	}
-	for i, r := range lit {
-		if !unicode.IsLetter(r) && r != '_' && (i == 0 || !unicode.IsDigit(r)) {
-			return false
+		if form, ok = next.Cdr.(*list.Pair); !ok {
+			return nil, false
 		}
 	}
-	return true
-}
-
-func isValidSimpleIdentifier(sym *lib.Symbol) bool {
-	return sym.Package == "" && isValidGoIdentifier(sym.Identifier)
+	return nil, false
 }
 
 func isValidQualifiedIdentifier(sym *lib.Symbol) bool {
-	return isValidGoIdentifier(sym.Package) && sym.Package != "_" &&
-		isValidGoIdentifier(sym.Identifier) && sym.Identifier != "_"
+	return ast.ValidGoIdentifier(sym.Package) && sym.Package != "_" &&
+		ast.ValidGoIdentifier(sym.Identifier) && sym.Identifier != "_"
 }
 
 func isValidIdentifier(sym *lib.Symbol) bool {
 	if sym.Package == "" {
-		return isValidGoIdentifier(sym.Identifier)
+		return ast.ValidGoIdentifier(sym.Identifier)
 	}
 	return isValidQualifiedIdentifier(sym)
 }
@@ -196,12 +269,14 @@ var (
 	_array          = lib.Intern("", "array")
 	_begin          = lib.Intern("", "begin")
 	_declare        = lib.Intern("", "declare")
+	_init           = lib.Intern("", "init")
 	_ellipsis       = lib.Intern("", "...")
 	_use            = lib.Intern("", "use")
 	_ptr            = lib.Intern("", "*")
 	_slice          = lib.Intern("", "slice")
 	_type_alias     = lib.Intern("", "type-alias")
 	_values         = lib.Intern("", "values")
+	_blank          = lib.Intern("", "_")
 
 	_make        = lib.Intern("", "make")
 	_make_struct = lib.Intern("", "make-struct")
@@ -258,6 +333,7 @@ var (
 	_unquote          = lib.Intern("", "unquote")
 	_unquote_splicing = lib.Intern("", "unquote-splicing")
 	_splice           = lib.Intern("", "splice")
+	_spread           = lib.Intern("", "spread")
 )
 
 var (
@@ -267,10 +343,12 @@ var (
 	keyType          = lib.Intern("_keyword", "type")
 )
 
+// formatComment appends comment as line comments. NUL bytes, which Go
+// does not permit in source files, are escaped.
 func formatComment(result []byte, comment string) []byte {
 	for _, line := range strings.Split(comment, "\n") {
 		result = append(result, '/', '/', ' ')
-		result = append(result, strings.TrimSpace(line)...)
+		result = append(result, strings.ReplaceAll(strings.TrimSpace(line), "\x00", `\x00`)...)
 		result = append(result, '\n')
 	}
 	return result
@@ -284,40 +362,32 @@ func formatIdentifier(result []byte, ident *lib.Symbol) []byte {
 	return append(result, ident.Identifier...)
 }
 
-func (cmp *compiler) compilePackageClause() (result []byte) {
-	rd := cmp.reader
-	form, ok := rd.Read().(*list.Pair)
-	if !ok {
+func (cmp *compiler) compilePackageClause(result []byte) []byte {
+	form, ok := cmp.reader.Read().(*list.Pair)
+	if !ok || form == nil {
 		cmp.reader.Error(0, "package clause is not a list")
+		panic(bailout{})
 	}
-	pkgClause := form.ToSlice()
-	if len(pkgClause) < 2 || len(pkgClause) > 3 {
-		cmp.error(form, "package clause has invalid length")
-	}
-	if pkgClause[0] != _package {
-		cmp.error(form, "package clause starts with invalid keyword")
-	}
-	sym, ok := pkgClause[1].(*lib.Symbol)
-	if !ok {
-		cmp.error(form, "package name is not an identifier")
+	clause := cmp.parser.PackageClause(form)
+	if clause == nil {
+		panic(bailout{})
 	}
-	if !isValidSimpleIdentifier(sym) || sym.Identifier == "_" {
-		cmp.error(form, "invalid package name")
-	}
-	if len(pkgClause) == 3 {
-		if comment, ok := pkgClause[2].(string); !ok {
-			cmp.error(form, "package comment is not a string")
-		} else {
-			result = formatComment(result, comment)
-		}
+	if clause.Doc != "" {
+		result = formatComment(result, clause.Doc)
 	}
 	result = append(result, "package "...)
-	result = append(result, sym.Identifier...)
-	result = append(result, '\n', '\n')
-	return
+	result = append(result, clause.Name.Identifier...)
+	if clause.ExternalTest {
+		result = append(result, "_test"...)
+	}
+	return append(result, '\n', '\n')
 }
 
 func (cmp *compiler) compileGenDecl(result []byte, keyword string, allowLeadComment bool, form *list.Pair, f func(element interface{}) (string, []byte)) []byte {
+	if !list.IsProper(form) || form.Cdr == list.Nil() {
+		cmp.error(form, fmt.Sprintf("invalid %v declaration", form.Car))
+		return result
+	}
 	cdr := form.Cdr.(*list.Pair)
 	leadComment := false
 
@@ -353,6 +423,8 @@ func (cmp *compiler) compileGenDecl(result []byte, keyword string, allowLeadComm
 		}
 	}
 
+	mark := len(result)
+	empty := true
 	result = append(result, keyword...)
 	result = append(result, ' ', '(', '\n')
 	cdr.ForEach(func(element interface{}) {
@@ -360,186 +432,136 @@ func (cmp *compiler) compileGenDecl(result []byte, keyword string, allowLeadComm
 		if len(decl) == 0 {
 			return
 		}
+		empty = false
 		if comment != "" {
 			result = formatComment(result, comment)
 		}
 		result = append(result, decl...)
 	})
-	return append(result, ')', '\n', '\n')
-}
-
-func isValidImport(lit string) bool {
-	const illegalChars = `!"#$%&'()*,:;<=>?[\]^{|}` + "`\uFFFD"
-	for _, r := range lit {
-		if !unicode.IsGraphic(r) || unicode.IsSpace(r) || strings.ContainsRune(illegalChars, r) {
-			return false
-		}
+	if empty {
+		return result[:mark]
 	}
-	return lit != ""
+	return append(result, ')', '\n', '\n')
 }
 
 func (cmp *compiler) compileImportDecl(form *list.Pair) {
-	cmp.header = cmp.compileGenDecl(cmp.header, "import", false, form, func(element interface{}) (comment string, decl []byte) {
-		if inner, ok := element.(string); ok {
-			pkg := path.Base(inner)
+	if !list.IsProper(form) || form.Cdr == list.Nil() {
+		cmp.error(form, "invalid import declaration")
+		return
+	}
+	form.Cdr.(*list.Pair).ForEach(func(element interface{}) {
+		spec := cmp.parser.ImportSpec(form, element, false)
+		if spec == nil {
+			return
+		}
+		if spec.Name == nil {
+			pkg := path.Base(spec.Path)
 			if _, ok := cmp.reader.PackageToPath[pkg]; ok {
 				cmp.error(form, "ambiguous import")
 			}
-			cmp.reader.PackageToPath[pkg] = inner
-			cmp.reader.PathToPackage[inner] = pkg
-			decl = append(decl, '"')
-			decl = append(decl, inner...)
-			decl = append(decl, '"', '\n')
+			cmp.reader.PackageToPath[pkg] = spec.Path
+			cmp.reader.PathToPackage[spec.Path] = pkg
+			cmp.imports = append(cmp.imports, importSpec{path: spec.Path})
 			return
 		}
-		inner, ok := element.(*list.Pair)
-		if !ok {
-			cmp.error(form, "invalid import clause")
-		}
-		imp := inner.ToSlice()
-		if len(imp) < 2 || len(imp) > 3 {
-			cmp.error(inner, "import clause has invalid length")
-		}
-		var quoted bool
-		if imp[0] == _quote {
-			quoted = true
-			if len(imp) != 2 {
-				cmp.error(inner, "invalid quoted import")
-			}
-			inner, ok = imp[1].(*list.Pair)
-			if !ok {
-				cmp.error(form, "invalid quoted import")
-			}
-			imp = inner.ToSlice()
-			if len(imp) < 2 || len(imp) > 3 {
-				cmp.error(inner, "quoted import clause has invalid length")
-			}
-		}
-		ident, ok := imp[0].(*lib.Symbol)
-		if !ok {
-			cmp.error(inner, "import name is not an identifier")
-		}
-		if !isValidSimpleIdentifier(ident) {
-			cmp.error(inner, "invalid import identifier")
-		}
-		importName := ident.Identifier
-		path, ok := imp[1].(string)
-		if !ok {
-			cmp.error(inner, "import path is not a string")
-		}
-		if !isValidImport(path) {
-			cmp.error(inner, "invalid import path: "+path)
-		}
-		if len(imp) == 3 {
-			if comment, ok = imp[2].(string); !ok {
-				cmp.error(inner, "import comment is not a string")
-			}
+		if !cmp.clauseActive(spec.Form(), spec.Condition) {
+			return
 		}
+		importName := spec.Name.Identifier
 		if importName != "_" {
 			if _, ok := cmp.reader.PackageToPath[importName]; ok {
 				cmp.error(form, "ambiguous import")
 			}
-			cmp.reader.PackageToPath[importName] = path
-			if !quoted {
-				cmp.reader.PathToPackage[path] = importName
+			cmp.reader.PackageToPath[importName] = spec.Path
+			if !spec.Quoted {
+				cmp.reader.PathToPackage[spec.Path] = importName
 			}
 		}
-		if !quoted {
-			decl = append(decl, importName...)
-			decl = append(decl, ' ', '"')
-			decl = append(decl, path...)
-			decl = append(decl, '"', '\n')
+		if spec.Quoted {
+			if cmp.quoted == nil {
+				cmp.quoted = make(map[string]token.Position)
+			}
+			if _, ok := cmp.quoted[spec.Path]; !ok {
+				cmp.quoted[spec.Path] = cmp.position(spec.Form())
+			}
+		} else {
+			cmp.imports = append(cmp.imports, importSpec{name: importName, path: spec.Path, doc: spec.Doc})
 		}
-		return
 	})
 }
 
 func (cmp *compiler) compileUseDecl(form *list.Pair) {
 	cmp.header = cmp.compileGenDecl(cmp.header, "use", false, form, func(element interface{}) (_ string, _ []byte) {
-		if inner, ok := element.(string); ok {
-			pkg := path.Base(inner)
+		spec := cmp.parser.ImportSpec(form, element, true)
+		if spec == nil {
+			return
+		}
+		if spec.Name == nil {
+			pkg := path.Base(spec.Path)
 			if _, ok := cmp.reader.PackageToPath[pkg]; ok {
 				cmp.error(form, "ambiguous use declaration")
 			}
-			cmp.resolvePlugin(inner)
-			cmp.reader.PackageToPath[pkg] = "#" + inner
+			cmp.usePlugin(form, spec.Path)
+			cmp.reader.PackageToPath[pkg] = "#" + spec.Path
 			return
 		}
-		inner, ok := element.(*list.Pair)
-		if !ok {
-			cmp.error(form, "invalid use clause")
-		}
-		imp := inner.ToSlice()
-		if len(imp) < 2 || len(imp) > 3 {
-			cmp.error(inner, "use clause has invalid length")
-		}
-		var quoted bool
-		if imp[0] == _quote {
-			quoted = true
-			if len(imp) != 2 {
-				cmp.error(inner, "invalid quoted use declaration")
-			}
-			inner, ok = imp[1].(*list.Pair)
-			if !ok {
-				cmp.error(form, "invalid quoted use declaration")
-			}
-			imp = inner.ToSlice()
-			if len(imp) < 2 || len(imp) > 3 {
-				cmp.error(inner, "quoted use clause has invalid length")
-			}
-		}
-		ident, ok := imp[0].(*lib.Symbol)
-		if !ok {
-			cmp.error(inner, "plugin name is not an identifier")
-		}
-		if !isValidSimpleIdentifier(ident) {
-			cmp.error(inner, "invalid plugin identifier")
-		}
-		pluginName := ident.Identifier
-		path, ok := imp[1].(string)
-		if !ok {
-			cmp.error(inner, "plugin path is not a string")
-		}
-		if !isValidImport(path) {
-			cmp.error(inner, "invalid plugin path: "+path)
-		}
-		if len(imp) == 3 {
-			if _, ok := imp[2].(string); !ok {
-				cmp.error(inner, "plugin comment is not a string")
-			}
+		if !cmp.clauseActive(spec.Form(), spec.Condition) {
+			return
 		}
-		if pluginName != "_" {
+		if pluginName := spec.Name.Identifier; pluginName != "_" {
 			if _, ok := cmp.reader.PackageToPath[pluginName]; ok {
 				cmp.error(form, "ambiguous use declaration")
 			}
-			cmp.reader.PackageToPath[pluginName] = "#" + path
-			if !quoted {
-				cmp.resolvePlugin(path)
-			}
+			cmp.reader.PackageToPath[pluginName] = "#" + spec.Path
+		}
+		if !spec.Quoted {
+			cmp.usePlugin(spec.Form(), spec.Path)
 		}
 		return
 	})
 }
 
+// checkConstValues reports an error unless there is one value per
+// identifier of a constant spec. If the values are repeated from a
+// previous spec in the group, at is the position of that spec.
+func (cmp *compiler) checkConstValues(form *list.Pair, syms []*lib.Symbol, values []interface{}, at *token.Position) {
+	switch {
+	case len(values) < len(syms):
+		cmp.error(form, fmt.Sprintf("missing init expr for %v", syms[len(values)].Identifier))
+	case len(values) > len(syms) && at != nil:
+		cmp.error(form, fmt.Sprintf("extra init expr at %v", *at))
+	case len(values) > len(syms):
+		cmp.error(form, fmt.Sprintf("extra init expr %v", values[len(syms)]))
+	}
+}
+
+// compileValueSpec returns the function that compiles the specs of a
+// const or var declaration. In a const declaration, a spec without
+// type and values repeats the type and the values of the previous spec
+// that has values, which is left to Go, but the number of identifiers
+// is checked here.
 func (cmp *compiler) compileValueSpec(form *list.Pair) func(element interface{}) (string, []byte) {
 	iota := 0
+	var previous []interface{}
+	var previousPos token.Position
 	return func(element interface{}) (comment string, decl []byte) {
 		defer func() { iota++ }()
 		switch e := element.(type) {
 		case *list.Pair:
-			var syms []*lib.Symbol
-			switch s := e.Car.(type) {
-			case *list.Pair:
-				syms = s.AppendToSlice(syms).([]*lib.Symbol)
-			case *lib.Symbol:
-				syms = []*lib.Symbol{s}
-			default:
+			if e == nil || !list.IsProper(e) {
+				cmp.error(form, fmt.Sprintf("invalid declaration %v", element))
+				return
+			}
+			syms := ast.Symbols(e.Car)
+			if len(syms) == 0 {
 				cmp.error(e, "invalid identifier(s)")
+				return
 			}
 			for _, ident := range syms {
-				if !isValidSimpleIdentifier(ident) {
+				if !ast.ValidSimpleIdentifier(ident) {
 					cmp.error(e, fmt.Sprintf("invalid identifier %v", ident.Identifier))
 				}
+				cmp.define(e, ident)
 			}
 
 			rest := e.Cdr.(*list.Pair)
@@ -567,14 +589,37 @@ func (cmp *compiler) compileValueSpec(form *list.Pair) func(element interface{})
 				decl = append(decl, ident.Identifier...)
 			}
 
+			for _, ident := range syms {
+				if typ {
+					cmp.declareVariable(ident, channelType(typForm))
+				} else if len(syms) == 1 {
+					cmp.declareVariable(ident, inferChannelType(valForm))
+				} else {
+					cmp.declareVariable(ident, nil)
+				}
+			}
+
 			if typ {
 				decl = append(decl, ' ')
 				decl = cmp.compileType(decl, e, typForm)
 			}
 
 			if val {
-				decl = append(decl, ' ', '=', ' ')
-				decl = cmp.compileExpression(decl, e, valForm)
+				values, ok := cmp.assignmentValues(e, valForm)
+				if form.Car == _const {
+					previous, previousPos = values, cmp.position(e)
+					if ok {
+						cmp.checkConstValues(e, syms, values, nil)
+					}
+				} else if ok {
+					cmp.checkAssignment(e, len(syms), values)
+				}
+				if ok {
+					decl = append(decl, ' ', '=', ' ')
+					decl = cmp.compileExpressionList(decl, e, values)
+				}
+			} else if form.Car == _const && !typ && previous != nil {
+				cmp.checkConstValues(e, syms, previous, &previousPos)
 			}
 
 			if doc {
@@ -585,15 +630,18 @@ func (cmp *compiler) compileValueSpec(form *list.Pair) func(element interface{})
 			}
 
 		case *lib.Symbol:
-			if !isValidSimpleIdentifier(e) {
+			if !ast.ValidSimpleIdentifier(e) {
 				cmp.error(form, fmt.Sprintf("invalid identifier %v", e.Identifier))
 			}
+			cmp.define(form, e)
 			switch form.Car {
 			case _var:
 				cmp.error(form, "missing variable type or initialization")
 			case _const:
 				if iota == 0 {
 					cmp.error(form, "missing constant value")
+				} else if previous != nil {
+					cmp.checkConstValues(form, []*lib.Symbol{e}, previous, &previousPos)
 				}
 			}
 			decl = append(decl, e.Identifier...)
@@ -611,20 +659,24 @@ func (cmp *compiler) compileValueSpec(form *list.Pair) func(element interface{})
 func (cmp *compiler) compileTypeSpec(form *list.Pair, alias bool) func(element interface{}) (string, []byte) {
 	return func(element interface{}) (comment string, decl []byte) {
 		inner, ok := element.(*list.Pair)
-		if !ok {
+		if !ok || inner == nil || !list.IsProper(inner) {
 			cmp.error(form, "invalid type spec")
+			return
 		}
 		spec := inner.ToSlice()
 		if len(spec) < 2 || len(spec) > 3 {
 			cmp.error(inner, "type spec has invalid length")
+			return
 		}
 		ident, ok := spec[0].(*lib.Symbol)
 		if !ok {
 			cmp.error(inner, "invalid identifier")
+			return
 		}
-		if !isValidSimpleIdentifier(ident) {
+		if !ast.ValidSimpleIdentifier(ident) {
 			cmp.error(inner, fmt.Sprintf("invalid identifier %v", ident.Identifier))
 		}
+		cmp.define(inner, ident)
 		decl = append(decl, ident.Identifier...)
 		if alias {
 			decl = append(decl, ' ', '=', ' ')
@@ -634,6 +686,7 @@ func (cmp *compiler) compileTypeSpec(form *list.Pair, alias bool) func(element i
 		if comment, ok = spec[1].(string); ok {
 			if len(spec) < 3 {
 				cmp.error(inner, "type spec has invalid length")
+				return
 			}
 			decl = cmp.compileType(decl, inner, spec[2])
 		} else {
@@ -642,137 +695,80 @@ func (cmp *compiler) compileTypeSpec(form *list.Pair, alias bool) func(element i
 			}
 			decl = cmp.compileType(decl, inner, spec[1])
 		}
+		decl = append(decl, '\n')
 		return
 	}
 }
 
 func (cmp *compiler) compileParameters(result []byte, form *list.Pair, ellipsisOk bool) []byte {
-	if form == list.Nil() {
-		return append(result, '(', ')')
-	}
+	return cmp.compileFields(result, cmp.parser.Fields(form, ellipsisOk))
+}
+
+func (cmp *compiler) compileFields(result []byte, fields []*ast.Field) []byte {
 	result = append(result, '(')
-	outer := form
-	for {
-		entryForm, ok := form.Car.(*list.Pair)
-		form = form.Cdr.(*list.Pair)
-		if !ok {
-			cmp.error(outer, "invalid parameter list entry")
-			continue
-		}
-		entry := entryForm.ToSlice()
-		if (ellipsisOk && (len(entry) < 2 || len(entry) > 3)) || len(entry) != 2 {
-			cmp.error(entryForm, "invalid parameter declaration length")
-		}
-		var names []*lib.Symbol
-		switch e := entry[0].(type) {
-		case *lib.Symbol:
-			names = []*lib.Symbol{e}
-		case *list.Pair:
-			names = e.AppendToSlice(names).([]*lib.Symbol)
-		}
-		if len(names) == 0 {
-			cmp.error(entryForm, fmt.Sprintf("invalid parameter names %v", entry[0]))
-		}
-		for _, name := range names {
-			if !isValidSimpleIdentifier(name) {
-				cmp.error(entryForm, fmt.Sprintf("invalid identifier %v", name))
-			}
+	for i, field := range fields {
+		if i > 0 {
+			result = append(result, ',', ' ')
 		}
-		result = append(result, names[0].Identifier...)
-		for _, name := range names[1:] {
+		result = append(result, field.Names[0].Identifier...)
+		for _, name := range field.Names[1:] {
 			result = append(result, ',', ' ')
 			result = append(result, name.Identifier...)
 		}
 		result = append(result, ' ')
-		var typeForm interface{}
-		if ellipsisOk && entry[1] == _ellipsis {
-			if len(entry) != 3 {
-				cmp.error(entryForm, "invalid parameter type")
-				continue
-			}
-			if form != list.Nil() {
-				cmp.error(entryForm, "variadic parameter is not the final entry in parameter list")
-			}
+		if field.Variadic {
 			result = append(result, '.', '.', '.')
-			typeForm = entry[2]
-		}
-		if len(entry) == 2 {
-			typeForm = entry[1]
 		}
-		result = cmp.compileType(result, entryForm, typeForm)
-		if form == list.Nil() {
-			break
-		}
-		result = append(result, ',', ' ')
+		result = cmp.compileType(result, field.Form(), field.Type)
 	}
 	return append(result, ')')
 }
 
 func (cmp *compiler) compileFuncDecl(result []byte, form *list.Pair) []byte {
-	head := []byte("func ")
-
-	rest := form.Cdr.(*list.Pair)
-	if first, ok := rest.Car.(*list.Pair); ok {
-		head = cmp.compileParameters(head, first, false)
-		head = append(head, ' ')
-		rest = rest.Cdr.(*list.Pair)
-	}
-
-	ident, ok := rest.Car.(*lib.Symbol)
-	if !ok {
-		cmp.error(form, "function name is not an identifier")
+	decl := cmp.parser.FuncDecl(form)
+	if decl == nil {
+		return result
 	}
-	if !isValidSimpleIdentifier(ident) || ident.Identifier == "_" {
-		cmp.error(form, "invalid function name")
+	if decl.Recv == nil && decl.Name.Identifier != "init" {
+		cmp.define(form, decl.Name)
 	}
-	head = append(head, ident.Identifier...)
-	head = append(head, ' ')
-	rest = rest.Cdr.(*list.Pair)
-
-	if rest == list.Nil() {
-		result = append(result, head...)
-		return append(result, '(', ')', '\n', '\n')
-	}
-
-	first, ok := rest.Car.(*list.Pair)
-	if !ok {
-		cmp.error(form, "missing parameter list in function declaration")
-	} else {
-		head = cmp.compileParameters(head, first, true)
-		head = append(head, ' ')
-		rest = rest.Cdr.(*list.Pair)
+	if decl.Doc != "" {
+		result = formatComment(result, decl.Doc)
 	}
-
-	if rest == list.Nil() {
-		result = append(result, head...)
-		return append(result, '\n', '\n')
+	result = append(result, "func "...)
+	if decl.Recv != nil {
+		cmp.declareParameters(decl.Recv)
+		result = cmp.compileFields(result, decl.Recv)
+		result = append(result, ' ')
 	}
-
-	first, ok = rest.Car.(*list.Pair)
-	if !ok {
-		cmp.error(form, "missing result list in function declaration")
-	} else if first != list.Nil() {
-		head = cmp.compileParameters(head, first, false)
-		head = append(head, ' ')
-		rest = rest.Cdr.(*list.Pair)
+	result = append(result, decl.Name.Identifier...)
+	cmp.declareParameters(decl.Params)
+	result = cmp.compileFields(result, decl.Params)
+	if len(decl.Results) > 0 {
+		cmp.declareParameters(decl.Results)
+		result = append(result, ' ')
+		result = cmp.compileFields(result, decl.Results)
 	}
-
-	if rest == list.Nil() {
-		result = append(result, head...)
-		return append(result, '\n', '\n')
+	if decl.HasBody {
+		result = append(result, ' ')
+		result = cmp.compileBlock(result, form, decl.Body)
 	}
+	return append(result, '\n', '\n')
+}
 
-	if comment, ok := rest.Car.(string); ok {
-		result = formatComment(result, comment)
-		rest = rest.Cdr.(*list.Pair)
+func (cmp *compiler) compileInitDecl(result []byte, form *list.Pair) []byte {
+	if !list.IsProper(form.Cdr) {
+		cmp.error(form, "invalid init declaration")
+		return result
 	}
-
-	result = append(result, head...)
-
-	if rest == list.Nil() {
-		return append(result, '\n', '\n')
+	rest := form.Cdr.(*list.Pair)
+	if rest != list.Nil() {
+		if comment, ok := rest.Car.(string); ok {
+			result = formatComment(result, comment)
+			rest = rest.Cdr.(*list.Pair)
+		}
 	}
-
+	result = append(result, "func init() "...)
 	result = cmp.compileBlock(result, form, rest)
 	return append(result, '\n', '\n')
 }
@@ -781,6 +777,7 @@ func (cmp *compiler) compilePragma(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 2 {
 		cmp.error(form, "declare form has invalid length")
+		return result
 	}
 	declString, ok := decl[1].(string)
 	if !ok {
@@ -801,12 +798,23 @@ func (cmp *compiler) compileDecl(result []byte, form *list.Pair) []byte {
 	var f func(element interface{}) (string, []byte)
 	var keyword string
 	for {
+		if !list.IsProper(form) {
+			cmp.error(form, fmt.Sprintf("invalid declaration %v", form))
+			return result
+		}
 		switch form.Car {
 		case _splice:
-			block := form.ToSlice()
-			for _, blockEntry := range block[1:] {
-				result = cmp.compileDecl(result, blockEntry.(*list.Pair))
+			body, ok := cmp.spliceBody(form)
+			if !ok {
+				return result
 			}
+			body.ForEach(func(element interface{}) {
+				if decl, ok := element.(*list.Pair); ok && decl != nil {
+					result = cmp.compileDecl(result, decl)
+				} else {
+					cmp.error(form, fmt.Sprintf("invalid declaration %v in splice", element))
+				}
+			})
 			return result
 
 		case _const:
@@ -831,22 +839,25 @@ func (cmp *compiler) compileDecl(result []byte, form *list.Pair) []byte {
 		case _declare:
 			return cmp.compilePragma(result, form)
 
+		case _define_constant:
+			return cmp.compileConstantDecl(result, form)
+
+		case _init:
+			return cmp.compileInitDecl(result, form)
+
 		default:
 			if sym, ok := form.Car.(*lib.Symbol); ok {
 				if len(sym.Package) > 0 && sym.Package[0] == '#' {
-					p := cmp.resolvePlugin(sym.Package)
-					macroSym, err := p.Lookup(sym.Identifier)
-					if err != nil {
-						cmp.error(form, "invalid macro invocation")
+					newForm, ok := cmp.expandMacro(form, form, sym)
+					if !ok {
 						return result
 					}
-					newForm, err := macroSym.(macro)(form, Environment{})
-					if err != nil {
-						cmp.error(form, fmt.Sprintf("error during macroexpansion: %v", err))
-						return result
+					if decl, ok := newForm.(*list.Pair); ok && decl != nil {
+						form = decl
+						continue
 					}
-					form = newForm.(*list.Pair)
-					continue
+					cmp.error(form, fmt.Sprintf("macro %v expanded into invalid declaration %v", sym.Identifier, newForm))
+					return result
 				}
 			}
 			cmp.error(form, "invalid declaration")
@@ -861,6 +872,7 @@ func (cmp *compiler) compileArrayType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 3 {
 		cmp.error(form, "invalid array type declaration")
+		return result
 	}
 	result = append(result, '[')
 	if decl[1] == _ellipsis {
@@ -873,38 +885,45 @@ func (cmp *compiler) compileArrayType(result []byte, form *list.Pair) []byte {
 }
 
 func (cmp *compiler) compileStructType(result []byte, form *list.Pair) []byte {
-	rest := form.Cdr.(*list.Pair)
+	rest, ok := form.Cdr.(*list.Pair)
+	if !ok || !list.IsProper(rest) {
+		cmp.error(form, fmt.Sprintf("invalid struct type declaration %v", form))
+		return result
+	}
 	if rest == list.Nil() {
 		return append(result, "struct{}"...)
 	}
 	result = append(result, "struct{\n"...)
 	rest.ForEach(func(element interface{}) {
 		eForm, ok := element.(*list.Pair)
-		if !ok {
+		if !ok || eForm == nil {
 			cmp.error(form, fmt.Sprintf("invalid struct type entry %v", element))
 			return
 		}
-		rest := eForm.Cdr.(*list.Pair)
-		cmp.checkf(eForm, rest, keyDocumentation, keyTag)
+		rest, ok := eForm.Cdr.(*list.Pair)
+		if !ok || !list.IsProper(rest) || rest.Length()%2 != 0 {
+			cmp.error(eForm, fmt.Sprintf("invalid struct type entry %v", element))
+			return
+		}
+		cmp.checkf(eForm, rest, keyType, keyDocumentation, keyTag)
 		docForm, doc := getf(rest, keyDocumentation)
 		typForm, typ := getf(rest, keyType)
 		tagForm, tag := getf(rest, keyTag)
 		if doc {
-			result = formatComment(result, docForm.(string))
+			if comment, ok := docForm.(string); ok {
+				result = formatComment(result, comment)
+			} else {
+				cmp.error(eForm, "comment is not a string")
+			}
 		}
 		if typ {
-			var names []*lib.Symbol
-			switch e := eForm.Car.(type) {
-			case *lib.Symbol:
-				names = []*lib.Symbol{e}
-			case *list.Pair:
-				names = e.AppendToSlice(names).([]*lib.Symbol)
-			}
+			names := ast.Symbols(eForm.Car)
 			if len(names) == 0 {
-				cmp.error(eForm, fmt.Sprintf("invalid identifiers %v", form.Car))
+				cmp.error(eForm, fmt.Sprintf("invalid identifiers %v", eForm.Car))
+				return
 			}
 			for _, name := range names {
-				if !isValidSimpleIdentifier(name) {
+				if !ast.ValidSimpleIdentifier(name) {
 					cmp.error(eForm, fmt.Sprintf("invalid identifier %v", name))
 				}
 			}
@@ -914,9 +933,9 @@ func (cmp *compiler) compileStructType(result []byte, form *list.Pair) []byte {
 				result = append(result, name.Identifier...)
 			}
 			result = append(result, ' ')
-			result = cmp.compileType(result, form, typForm)
+			result = cmp.compileType(result, eForm, typForm)
 		} else {
-			result = cmp.compileType(result, form, form.Car)
+			result = cmp.compileType(result, eForm, eForm.Car)
 		}
 		if tag {
 			if tag, ok := tagForm.(string); !ok {
@@ -935,6 +954,7 @@ func (cmp *compiler) compilePointerType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 2 {
 		cmp.error(form, "invalid pointer type declaration")
+		return result
 	}
 	result = append(result, '*')
 	return cmp.compileType(result, form, decl[1])
@@ -944,21 +964,36 @@ func (cmp *compiler) compileFuncType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) < 1 || len(decl) > 3 {
 		cmp.error(form, "invalid function type declaration")
+		return result
 	}
 	result = append(result, "func "...)
 	if len(decl) == 1 {
 		return append(result, '(', ')')
 	}
-	result = cmp.compileParameters(result, decl[1].(*list.Pair), true)
+	params, ok := decl[1].(*list.Pair)
+	if !ok {
+		cmp.error(form, fmt.Sprintf("invalid parameter list %v", decl[1]))
+		return result
+	}
+	result = cmp.compileParameters(result, params, true)
 	if len(decl) == 3 && decl[2] != list.Nil() {
+		results, ok := decl[2].(*list.Pair)
+		if !ok {
+			cmp.error(form, fmt.Sprintf("invalid parameter list %v", decl[2]))
+			return result
+		}
 		result = append(result, ' ')
-		result = cmp.compileParameters(result, decl[2].(*list.Pair), false)
+		result = cmp.compileParameters(result, results, false)
 	}
 	return result
 }
 
 func (cmp *compiler) compileInterfaceType(result []byte, form *list.Pair) []byte {
-	rest := form.Cdr.(*list.Pair)
+	rest, ok := form.Cdr.(*list.Pair)
+	if !ok || !list.IsProper(rest) {
+		cmp.error(form, fmt.Sprintf("invalid interface type declaration %v", form))
+		return result
+	}
 	if rest == list.Nil() {
 		return append(result, "interface{}"...)
 	}
@@ -966,7 +1001,7 @@ func (cmp *compiler) compileInterfaceType(result []byte, form *list.Pair) []byte
 	rest.ForEach(func(element interface{}) {
 		switch e := element.(type) {
 		case *lib.Symbol:
-			sym := cmp.encloseSymbol(e)
+			sym := cmp.encloseSymbol(form, e)
 			if !isValidQualifiedIdentifier(sym) {
 				cmp.error(form, fmt.Sprintf("invalid identifier %v", sym))
 				return
@@ -974,30 +1009,47 @@ func (cmp *compiler) compileInterfaceType(result []byte, form *list.Pair) []byte
 			result = formatIdentifier(result, sym)
 			result = append(result, '\n')
 		case *list.Pair:
+			if !list.IsProper(e) {
+				cmp.error(form, fmt.Sprintf("invalid interface type entry %v", element))
+				return
+			}
 			spec := e.ToSlice()
 			if len(spec) < 1 || len(spec) > 4 {
 				cmp.error(e, fmt.Sprintf("invalid interface type entry %v", element))
 				return
 			}
-			if spec[1] == keyDocumentation {
+			if len(spec) > 1 && spec[1] == keyDocumentation {
 				if len(spec) != 3 {
 					cmp.error(e, fmt.Sprintf("invalid interface type entry %v", element))
 					return
 				}
 				ident, ok := spec[0].(*lib.Symbol)
-				sym := cmp.encloseSymbol(ident)
-				if !ok || !isValidQualifiedIdentifier(sym) {
+				if !ok {
+					cmp.error(e, fmt.Sprintf("invalid identifier %v", spec[0]))
+					return
+				}
+				sym := cmp.encloseSymbol(e, ident)
+				if !isValidQualifiedIdentifier(sym) {
 					cmp.error(e, fmt.Sprintf("invalid identifier %v", sym))
 					return
 				}
-				result = formatComment(result, spec[2].(string))
+				if comment, ok := spec[2].(string); ok {
+					result = formatComment(result, comment)
+				} else {
+					cmp.error(e, "comment is not a string")
+				}
 				result = formatIdentifier(result, sym)
+				result = append(result, '\n')
 				return
 			}
 			if len(spec) == 4 {
-				result = formatComment(result, spec[3].(string))
+				if comment, ok := spec[3].(string); ok {
+					result = formatComment(result, comment)
+				} else {
+					cmp.error(e, "comment is not a string")
+				}
 			}
-			if name, ok := spec[0].(*lib.Symbol); !ok || !isValidSimpleIdentifier(name) || name.Identifier == "_" {
+			if name, ok := spec[0].(*lib.Symbol); !ok || !ast.ValidSimpleIdentifier(name) || name.Identifier == "_" {
 				cmp.error(e, fmt.Sprintf("invalid interface type entry name %v", spec[0]))
 			} else {
 				result = formatIdentifier(result, name)
@@ -1007,10 +1059,20 @@ func (cmp *compiler) compileInterfaceType(result []byte, form *list.Pair) []byte
 				result = append(result, '(', ')', '\n')
 				break
 			}
-			result = cmp.compileParameters(result, spec[1].(*list.Pair), true)
+			params, ok := spec[1].(*list.Pair)
+			if !ok {
+				cmp.error(e, fmt.Sprintf("invalid parameter list %v", spec[1]))
+				return
+			}
+			result = cmp.compileParameters(result, params, true)
 			if len(spec) >= 3 && spec[2] != list.Nil() {
+				results, ok := spec[2].(*list.Pair)
+				if !ok {
+					cmp.error(e, fmt.Sprintf("invalid parameter list %v", spec[2]))
+					return
+				}
 				result = append(result, ' ')
-				result = cmp.compileParameters(result, spec[2].(*list.Pair), false)
+				result = cmp.compileParameters(result, results, false)
 			}
 			result = append(result, '\n')
 		default:
@@ -1024,6 +1086,7 @@ func (cmp *compiler) compileSliceType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 2 {
 		cmp.error(form, "invalid slice type declaration")
+		return result
 	}
 	result = append(result, '[', ']')
 	return cmp.compileType(result, form, decl[1])
@@ -1033,6 +1096,7 @@ func (cmp *compiler) compileMapType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 3 {
 		cmp.error(form, "invalid map type declaration")
+		return result
 	}
 	result = append(result, "map["...)
 	result = cmp.compileType(result, form, decl[1])
@@ -1044,8 +1108,14 @@ func (cmp *compiler) compileChannelType(result []byte, form *list.Pair) []byte {
 	decl := form.ToSlice()
 	if len(decl) != 2 {
 		cmp.error(form, "invalid channel type declaration")
+		return result
+	}
+	dir, ok := decl[0].(*lib.Symbol)
+	if !ok {
+		cmp.error(form, "invalid channel type declaration")
+		return result
 	}
-	result = append(result, decl[0].(*lib.Symbol).Identifier...)
+	result = append(result, dir.Identifier...)
 	result = append(result, ' ')
 	return cmp.compileType(result, form, decl[1])
 }
@@ -1053,13 +1123,17 @@ func (cmp *compiler) compileChannelType(result []byte, form *list.Pair) []byte {
 func (cmp *compiler) compileType(result []byte, outer *list.Pair, form interface{}) []byte {
 	switch typeForm := form.(type) {
 	case *lib.Symbol:
-		sym := cmp.encloseSymbol(typeForm)
+		sym := cmp.encloseSymbol(outer, typeForm)
 		if !isValidIdentifier(sym) {
 			cmp.error(outer, fmt.Sprintf("invalid identifier %v", sym))
 			return result
 		}
 		return formatIdentifier(result, sym)
 	case *list.Pair:
+		if typeForm == nil || !list.IsProper(typeForm) {
+			cmp.error(outer, fmt.Sprintf("invalid type declaration %v", typeForm))
+			return result
+		}
 		switch typeForm.Car {
 		case _array:
 			return cmp.compileArrayType(result, typeForm)
@@ -1102,6 +1176,10 @@ func (cmp *compiler) compileSimpleStatement(result []byte, form *list.Pair) []by
 	if form == nil {
 		return append(result, '\n')
 	}
+	if !list.IsProper(form) {
+		cmp.error(form, fmt.Sprintf("invalid statement %v", form))
+		return result
+	}
 	slice := form.ToSlice()
 	switch slice[0] {
 	case _arrow_right:
@@ -1109,6 +1187,7 @@ func (cmp *compiler) compileSimpleStatement(result []byte, form *list.Pair) []by
 			cmp.error(form, "invalid channel send statement")
 			return result
 		}
+		cmp.checkSend(form, slice[1])
 		result = cmp.compileExpression(result, form, slice[1])
 		result = append(result, ' ', '<', '-', ' ')
 		result = cmp.compileExpression(result, form, slice[2])
@@ -1119,10 +1198,23 @@ func (cmp *compiler) compileSimpleStatement(result []byte, form *list.Pair) []by
 		}
 		result = cmp.compileExpression(result, form, slice[1])
 		result = append(result, slice[0].(*lib.Symbol).Identifier...)
-	case _equal, _plus_equal, _minus_equal, _or_equal, _xor_equal, _mul_equal, _div_equal, _rem_equal,
+	case _equal:
+		if len(slice) != 3 {
+			cmp.error(form, "invalid assignment statement")
+			return result
+		}
+		result = cmp.compileAssignment(result, form, slice[1], slice[2])
+	case _plus_equal, _minus_equal, _or_equal, _xor_equal, _mul_equal, _div_equal, _rem_equal,
 		_lshift_equal, _rshift_equal, _and_equal, _and_not_equal:
 		if len(slice) != 3 {
 			cmp.error(form, "invalid assignment statement")
+			return result
+		}
+		for _, side := range slice[1:] {
+			if e, ok := side.(*list.Pair); ok && e != nil && e.Car == _values {
+				cmp.error(form, fmt.Sprintf("assignment operation %v requires single-valued expressions", slice[0]))
+				return result
+			}
 		}
 		result = cmp.compileExpression(result, form, slice[1])
 		result = append(result, ' ')
@@ -1132,30 +1224,19 @@ func (cmp *compiler) compileSimpleStatement(result []byte, form *list.Pair) []by
 	case _colon_equal:
 		if len(slice) != 3 {
 			cmp.error(form, "invalid short variable definition")
+			return result
 		}
-		var names []*lib.Symbol
-		switch e := slice[1].(type) {
-		case *lib.Symbol:
-			names = []*lib.Symbol{e}
-		case *list.Pair:
-			names = e.AppendToSlice(names).([]*lib.Symbol)
-		}
+		names := ast.Symbols(slice[1])
 		if len(names) == 0 {
 			cmp.error(form, fmt.Sprintf("invalid identifiers %v", slice[1]))
-			break
+			return result
 		}
 		for _, name := range names {
-			if !isValidSimpleIdentifier(name) {
+			if !ast.ValidSimpleIdentifier(name) {
 				cmp.error(form, fmt.Sprintf("invalid identifier %v", name))
 			}
 		}
-		result = append(result, names[0].Identifier...)
-		for _, name := range names[1:] {
-			result = append(result, ',', ' ')
-			result = append(result, name.Identifier...)
-		}
-		result = append(result, ' ', ':', '=', ' ')
-		result = cmp.compileExpression(result, form, slice[2])
+		result = cmp.compileShortVariableDeclaration(result, form, names, slice[2])
 	default:
 		result = cmp.compileExpression(result, form, form)
 	}
@@ -1176,7 +1257,11 @@ func (cmp *compiler) compileSelectStatement(result []byte, form *list.Pair) []by
 	result = append(result, "select {\n"...)
 	var defaultSeen bool
 	form.Cdr.(*list.Pair).ForEach(func(element interface{}) {
-		clause := element.(*list.Pair)
+		clause, ok := element.(*list.Pair)
+		if !ok || clause == nil || !list.IsProper(clause) {
+			cmp.error(form, fmt.Sprintf("invalid select clause %v", element))
+			return
+		}
 		if clause.Car == _default {
 			if defaultSeen {
 				cmp.error(form, "multiple default cases")
@@ -1184,13 +1269,8 @@ func (cmp *compiler) compileSelectStatement(result []byte, form *list.Pair) []by
 			defaultSeen = true
 			result = append(result, "default:\n"...)
 		} else {
-			head := clause.Car.(*list.Pair)
-			switch head.Car {
-			case _arrow_right, _arrow_left, _equal, _colon_equal:
-			default:
-				cmp.error(form, "invalid select statement")
-			}
-			result = cmp.compileSimpleStatement(result, head)
+			result = append(result, "case "...)
+			result = cmp.compileCommCase(result, form, clause.Car)
 			result = append(result, ':', '\n')
 		}
 		result = cmp.compileImplicitBlock(result, form, clause.Cdr.(*list.Pair))
@@ -1198,21 +1278,51 @@ func (cmp *compiler) compileSelectStatement(result []byte, form *list.Pair) []by
 	return append(result, '}', '\n')
 }
 
-func (cmp *compiler) compileSwitchStatement(result []byte, form *list.Pair, star bool) []byte {
+// compileSwitchHeader compiles the keyword and the optional simple
+// statement of a switch statement, and returns the remaining elements
+// of the form, which has at least the given number of them.
+func (cmp *compiler) compileSwitchHeader(result []byte, form *list.Pair, star bool, min int) ([]byte, *list.Pair, bool) {
 	rest := form.Cdr.(*list.Pair)
+	if star {
+		min++
+	}
+	if rest.Length() < min {
+		cmp.error(form, fmt.Sprintf("invalid %v statement", form.Car))
+		return result, nil, false
+	}
 	result = append(result, "switch "...)
 	if star {
-		result = cmp.compileSimpleStatement(result, rest.Car.(*list.Pair))
+		stmt, ok := rest.Car.(*list.Pair)
+		if !ok {
+			cmp.error(form, fmt.Sprintf("invalid simple statement %v in %v statement", rest.Car, form.Car))
+			return result, nil, false
+		}
+		result = cmp.compileSimpleStatement(result, stmt)
 		if result[len(result)-1] != '\n' {
 			result = append(result, ';', ' ')
 		}
 		rest = rest.Cdr.(*list.Pair)
 	}
+	return result, rest, true
+}
+
+func (cmp *compiler) compileSwitchStatement(result []byte, form *list.Pair, star bool) []byte {
+	result, rest, ok := cmp.compileSwitchHeader(result, form, star, 1)
+	if !ok {
+		return result
+	}
 	result = cmp.compileExpression(result, form, rest.Car)
 	result = append(result, ' ', '{', '\n')
 	var defaultSeen bool
-	rest.Cdr.(*list.Pair).ForEach(func(element interface{}) {
-		clause := element.(*list.Pair)
+	var fallenInto *list.Pair
+	clauses := rest.Cdr.(*list.Pair).ToSlice()
+	for i, element := range clauses {
+		clause, ok := element.(*list.Pair)
+		if !ok || clause == nil || !list.IsProper(clause) {
+			cmp.error(form, fmt.Sprintf("invalid switch clause %v", element))
+			fallenInto = nil
+			continue
+		}
 		if clause.Car == _default {
 			if defaultSeen {
 				cmp.error(form, "multiple default cases")
@@ -1225,6 +1335,11 @@ func (cmp *compiler) compileSwitchStatement(result []byte, form *list.Pair, star
 			default:
 				result = cmp.compileExpression(result, form, head)
 			case *list.Pair:
+				if head == nil || !list.IsProper(head) {
+					cmp.error(clause, fmt.Sprintf("invalid switch case %v", head))
+					fallenInto = nil
+					continue
+				}
 				result = cmp.compileExpression(result, form, head.Car)
 				head.Cdr.(*list.Pair).ForEach(func(element interface{}) {
 					result = append(result, ',', ' ')
@@ -1233,26 +1348,23 @@ func (cmp *compiler) compileSwitchStatement(result []byte, form *list.Pair, star
 			}
 			result = append(result, ':', '\n')
 		}
-		result = cmp.compileImplicitBlock(result, form, clause.Cdr.(*list.Pair))
-	})
+		result, fallenInto = cmp.compileCaseBody(result, form, clause, fallenInto, false, i == len(clauses)-1)
+	}
 	return append(result, '}', '\n')
 }
 
 func (cmp *compiler) compileTypeSwitchStatement(result []byte, form *list.Pair, star bool) []byte {
-	rest := form.Cdr.(*list.Pair)
-	result = append(result, "switch "...)
-	if star {
-		result = cmp.compileSimpleStatement(result, rest.Car.(*list.Pair))
-		if result[len(result)-1] != '\n' {
-			result = append(result, ';', ' ')
-		}
-		rest = rest.Cdr.(*list.Pair)
+	result, rest, ok := cmp.compileSwitchHeader(result, form, star, 2)
+	if !ok {
+		return result
 	}
-	sym := rest.Car.(*lib.Symbol)
-	if !isValidSimpleIdentifier(sym) {
+	sym, ok := rest.Car.(*lib.Symbol)
+	if !ok || !ast.ValidSimpleIdentifier(sym) {
 		cmp.error(form, "invalid variable declaration")
+		return result
 	}
 	if sym.Identifier != "_" {
+		cmp.declareVariable(sym, nil)
 		result = append(result, sym.Identifier...)
 		result = append(result, ' ', ':', '=', ' ')
 	}
@@ -1261,7 +1373,11 @@ func (cmp *compiler) compileTypeSwitchStatement(result []byte, form *list.Pair,
 	result = append(result, ".(type) {\n"...)
 	var defaultSeen bool
 	rest.Cdr.(*list.Pair).ForEach(func(element interface{}) {
-		clause := element.(*list.Pair)
+		clause, ok := element.(*list.Pair)
+		if !ok || clause == nil || !list.IsProper(clause) {
+			cmp.error(form, fmt.Sprintf("invalid type-switch clause %v", element))
+			return
+		}
 		if clause.Car == _default {
 			if defaultSeen {
 				cmp.error(form, "multiple default cases")
@@ -1274,6 +1390,10 @@ func (cmp *compiler) compileTypeSwitchStatement(result []byte, form *list.Pair,
 			case *lib.Symbol:
 				result = cmp.compileType(result, form, head)
 			case *list.Pair:
+				if head == nil || !list.IsProper(head) {
+					cmp.error(clause, fmt.Sprintf("invalid type-switch case %v", head))
+					return
+				}
 				result = cmp.compileType(result, form, head.Car)
 				head.Cdr.(*list.Pair).ForEach(func(element interface{}) {
 					result = append(result, ',', ' ')
@@ -1284,24 +1404,120 @@ func (cmp *compiler) compileTypeSwitchStatement(result []byte, form *list.Pair,
 			}
 			result = append(result, ':', '\n')
 		}
-		result = cmp.compileImplicitBlock(result, form, clause.Cdr.(*list.Pair))
+		result, _ = cmp.compileCaseBody(result, form, clause, nil, true, false)
 	})
 	return append(result, '}', '\n')
 }
 
-func (cmp *compiler) compileForStatement(result []byte, form *list.Pair) []byte {
+// compileCaseBody compiles the statements of a case clause of a switch
+// statement, which may be preceded by a :when guard. A fallthrough
+// statement may only be the last statement of an unguarded clause of an
+// expression switch, and not in its final clause, nor in the clause
+// before a guarded clause, since the guard would then be evaluated
+// after falling through. fallenInto is the fallthrough statement of the
+// previous clause, if any, and the fallthrough statement of this clause
+// is returned.
+func (cmp *compiler) compileCaseBody(result []byte, form, clause, fallenInto *list.Pair, typeSwitch, final bool) ([]byte, *list.Pair) {
+	body, ok := clause.Cdr.(*list.Pair)
+	if !ok || !list.IsProper(body) {
+		cmp.error(clause, fmt.Sprintf("invalid case clause %v", clause))
+		return result, nil
+	}
+	guarded := body != list.Nil() && body.Car == keyWhen
+	if guarded {
+		rest, ok := body.Cdr.(*list.Pair)
+		if !ok || rest == list.Nil() {
+			cmp.error(clause, "missing case guard")
+			return result, nil
+		}
+		if clause.Car == _default {
+			cmp.error(clause, "default case with a guard")
+		}
+		if fallenInto != nil {
+			cmp.error(fallenInto, "fallthrough statement into guarded case")
+		}
+		result = append(result, "if "...)
+		result = cmp.compileExpression(result, clause, rest.Car)
+		result = append(result, ' ', '{', '\n')
+		body = rest.Cdr.(*list.Pair)
+	}
+	stmts := cmp.spliceExpressions(form, body.ToSlice())
+	var fallthroughStmt *list.Pair
+	for i, stmt := range stmts {
+		if s, ok := stmt.(*list.Pair); ok && s != nil && s.Car == _fallthrough {
+			switch {
+			case typeSwitch:
+				cmp.error(s, "fallthrough statement in type switch")
+				continue
+			case final:
+				cmp.error(s, "fallthrough statement in final case of switch")
+				continue
+			case guarded:
+				cmp.error(s, "fallthrough statement in guarded case")
+				continue
+			case i != len(stmts)-1:
+				cmp.error(s, "fallthrough statement is not the last statement in case")
+				continue
+			}
+			cmp.fallthroughStmt = s
+			fallthroughStmt = s
+		}
+		result = cmp.compileStatement(result, form, stmt, false)
+	}
+	cmp.fallthroughStmt = nil
+	if guarded {
+		return append(result, '}', '\n'), fallthroughStmt
+	}
+	if len(stmts) == 0 {
+		return append(result, '\n'), fallthroughStmt
+	}
+	return result, fallthroughStmt
+}
+
+// compileLoopLabel compiles the optional label that follows the keyword
+// of a loop form, and returns the remaining elements of the form.
+func (cmp *compiler) compileLoopLabel(result []byte, form *list.Pair) ([]byte, *list.Pair) {
 	rest := form.Cdr.(*list.Pair)
-	result = append(result, "for "...)
-	clause := rest.Car.(*list.Pair).ToSlice()
-	if len(clause) > 3 {
+	if rest == list.Nil() {
+		return result, rest
+	}
+	label, ok := rest.Car.(*lib.Symbol)
+	if !ok || label.Package != "_keyword" {
+		return result, rest
+	}
+	if !ast.ValidGoIdentifier(label.Identifier) || label.Identifier == "_" {
+		cmp.error(form, fmt.Sprintf("invalid label name %v", label))
+	}
+	result = append(result, label.Identifier...)
+	result = append(result, ':', '\n')
+	rest, ok = rest.Cdr.(*list.Pair)
+	if !ok || rest == list.Nil() {
+		cmp.error(form, fmt.Sprintf("invalid %v statement", form.Car))
+		return result, list.Nil()
+	}
+	return result, rest
+}
+
+func (cmp *compiler) compileForStatement(result []byte, form *list.Pair) []byte {
+	result, rest := cmp.compileLoopLabel(result, form)
+	if rest == list.Nil() {
+		cmp.error(form, "invalid for statement")
+		return result
+	}
+	header, ok := rest.Car.(*list.Pair)
+	if !ok || !list.IsProper(header) || header.Length() > 3 {
 		cmp.error(form, "invalid for statement")
+		return result
 	}
+	result = append(result, "for "...)
+	clause := header.ToSlice()
 	if len(clause) == 0 {
-		return cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+		result = cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+		return append(result, '\n')
 	}
 	if len(clause) > 0 {
 		if clause[0] != list.Nil() {
-			result = cmp.compileSimpleStatement(result, clause[0].(*list.Pair))
+			result = cmp.compileForClause(result, form, clause[0])
 		}
 	}
 	if result[len(result)-1] != '\n' {
@@ -1317,72 +1533,143 @@ func (cmp *compiler) compileForStatement(result []byte, form *list.Pair) []byte
 	}
 	if len(clause) > 2 {
 		if clause[2] != list.Nil() {
-			result = cmp.compileSimpleStatement(result, clause[2].(*list.Pair))
+			result = cmp.compileForClause(result, form, clause[2])
+			result = bytes.TrimSuffix(result, []byte{'\n'})
 		}
 	}
 	result = append(result, ' ')
-	return cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	result = cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	return append(result, '\n')
+}
+
+// compileForClause compiles the init or post statement of a for statement.
+func (cmp *compiler) compileForClause(result []byte, form *list.Pair, clause interface{}) []byte {
+	stmt, ok := clause.(*list.Pair)
+	if !ok {
+		cmp.error(form, fmt.Sprintf("invalid simple statement %v in for statement", clause))
+		return result
+	}
+	return cmp.compileSimpleStatement(result, stmt)
 }
 
 func (cmp *compiler) compileWhileStatement(result []byte, form *list.Pair) []byte {
-	rest := form.Cdr.(*list.Pair)
+	result, rest := cmp.compileLoopLabel(result, form)
+	if rest == list.Nil() {
+		cmp.error(form, "invalid while statement")
+		return result
+	}
 	result = append(result, "for "...)
 	result = cmp.compileExpression(result, form, rest.Car)
 	result = append(result, ' ')
-	return cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	result = cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	return append(result, '\n')
 }
 
 func (cmp *compiler) compileLoopStatement(result []byte, form *list.Pair) []byte {
 	result = append(result, "for "...)
-	return cmp.compileBlock(result, form, form.Cdr.(*list.Pair))
+	result = cmp.compileBlock(result, form, form.Cdr.(*list.Pair))
+	return append(result, '\n')
 }
 
 func (cmp *compiler) compileRangeStatement(result []byte, form *list.Pair) []byte {
-	rest := form.Cdr.(*list.Pair)
-	result = append(result, "for "...)
-	clause := rest.Car.(*list.Pair).ToSlice()
-	if len(clause) != 3 {
+	result, rest := cmp.compileLoopLabel(result, form)
+	if rest == list.Nil() {
 		cmp.error(form, "invalid range statement")
+		return result
+	}
+	header, ok := rest.Car.(*list.Pair)
+	if !ok || header == nil || !list.IsProper(header) {
+		cmp.error(form, "invalid range statement")
+		return result
 	}
+	clause := header.ToSlice()
+	var names []*lib.Symbol
+	var vars []interface{}
+	var rangeExpr interface{}
 	switch clause[0] {
 	case _colon_equal:
-		var names []*lib.Symbol
-		switch e := clause[1].(type) {
-		case *lib.Symbol:
-			names = []*lib.Symbol{e}
-		case *list.Pair:
-			names = e.AppendToSlice(names).([]*lib.Symbol)
+		if len(clause) != 3 {
+			cmp.error(form, "invalid range statement")
+			return result
 		}
-		if len(names) == 0 {
-			cmp.error(form, fmt.Sprintf("invalid identifiers %v", clause[1]))
+		if clause[1] != list.Nil() {
+			if names = ast.Symbols(clause[1]); len(names) == 0 {
+				cmp.error(form, fmt.Sprintf("invalid identifiers %v", clause[1]))
+				return result
+			}
 		}
 		for _, name := range names {
-			if !isValidSimpleIdentifier(name) {
+			if !ast.ValidSimpleIdentifier(name) {
 				cmp.error(form, fmt.Sprintf("invalid identifier %v", name))
 			}
 		}
+		for len(names) > 0 && names[len(names)-1] == _blank {
+			names = names[:len(names)-1]
+		}
+		for _, name := range names {
+			vars = append(vars, name)
+		}
+		rangeExpr = clause[2]
+	case _equal:
+		if len(clause) != 3 {
+			cmp.error(form, "invalid range statement")
+			return result
+		}
+		if vars, ok = cmp.assignmentValues(form, clause[1]); !ok {
+			return result
+		}
+		for len(vars) > 0 && vars[len(vars)-1] == _blank {
+			vars = vars[:len(vars)-1]
+		}
+		rangeExpr = clause[2]
+	default:
+		if len(clause) != 1 {
+			cmp.error(form, "invalid range statement")
+			return result
+		}
+		rangeExpr = clause[0]
+	}
+	if len(vars) > 2 {
+		cmp.error(form, "range clause permits at most two iteration variables")
+		return result
+	}
+	if sym, ok := rangeExpr.(*lib.Symbol); ok && cmp.channels[sym] != nil {
+		cmp.checkReceive(form, sym)
+		if len(vars) > 1 {
+			cmp.error(form, fmt.Sprintf("range over channel %v permits only one iteration variable", sym))
+			return result
+		}
+	}
+	result = append(result, "for "...)
+	switch {
+	case len(vars) == 0:
+		result = append(result, "range "...)
+	case clause[0] == _colon_equal:
 		result = append(result, names[0].Identifier...)
 		for _, name := range names[1:] {
 			result = append(result, ',', ' ')
 			result = append(result, name.Identifier...)
 		}
+		cmp.declareVariables(names)
 		result = append(result, " := range "...)
-	case _equal:
-		result = cmp.compileExpression(result, form, clause[1])
-		result = append(result, " = range "...)
 	default:
-		cmp.error(form, "invalid range statement")
+		result = cmp.compileExpressionList(result, form, vars)
+		result = append(result, " = range "...)
 	}
-	result = cmp.compileExpression(result, form, clause[2])
-	return cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	result = cmp.compileExpression(result, form, rangeExpr)
+	result = cmp.compileBlock(result, form, rest.Cdr.(*list.Pair))
+	return append(result, '\n')
 }
 
 func (cmp *compiler) compileStatement(result []byte, outer *list.Pair, stmt interface{}, atBlock bool) []byte {
+	if form, ok := stmt.(*list.Pair); ok {
+		result = cmp.markLine(result, form)
+	}
 	for {
 		switch form := stmt.(type) {
 		case *lib.Symbol:
 			if form.Package == "_keyword" {
-				if !isValidGoIdentifier(form.Identifier) || form.Identifier == "_" {
+				if !ast.ValidGoIdentifier(form.Identifier) || form.Identifier == "_" {
 					cmp.error(outer, fmt.Sprintf("invalid label name %v", stmt))
 				}
 				result = append(result, form.Identifier...)
@@ -1394,12 +1681,22 @@ func (cmp *compiler) compileStatement(result []byte, outer *list.Pair, stmt inte
 			if form == nil {
 				return cmp.compileSimpleStatement(result, form)
 			}
+			if !list.IsProper(form) {
+				cmp.error(outer, fmt.Sprintf("invalid statement %v", form))
+				return result
+			}
 			switch form.Car {
 			case _const, _type, _type_alias, _var:
-				return cmp.compileDecl(result, form)
+				local := cmp.local
+				cmp.local = true
+				result = cmp.compileDecl(result, form)
+				cmp.local = local
+				return result
 			case _arrow_right, _plus_plus, _minus_minus, _equal, _plus_equal, _minus_equal, _or_equal, _xor_equal,
 				_mul_equal, _div_equal, _rem_equal, _lshift_equal, _rshift_equal, _and_equal, _and_not_equal, _colon_equal:
 				return cmp.compileSimpleStatement(result, form)
+			case _colon_equal_const:
+				return cmp.compileConstantStatement(result, form)
 			case _go, _defer:
 				return cmp.compileDelayedStatement(result, form)
 			case _break, _continue, _goto:
@@ -1409,7 +1706,10 @@ func (cmp *compiler) compileStatement(result []byte, outer *list.Pair, stmt inte
 			case _fallthrough:
 				return cmp.compileFallthroughStatement(result, form)
 			case _splice:
-				return cmp.compileImplicitBlock(result, form, form.Cdr.(*list.Pair))
+				if body, ok := cmp.spliceBody(form); ok {
+					return cmp.compileImplicitBlock(result, form, body)
+				}
+				return result
 			case _begin:
 				if atBlock {
 					return cmp.compileImplicitBlock(result, form, form.Cdr.(*list.Pair))
@@ -1440,12 +1740,7 @@ func (cmp *compiler) compileStatement(result []byte, outer *list.Pair, stmt inte
 			default:
 				if sym, ok := form.Car.(*lib.Symbol); ok {
 					if len(sym.Package) > 0 && sym.Package[0] == '#' {
-						p := cmp.resolvePlugin(sym.Package)
-						if macroSym, err := p.Lookup(sym.Identifier); err != nil {
-							cmp.error(outer, "invalid macro invocation")
-						} else if newForm, err := macroSym.(macro)(form, Environment{}); err != nil {
-							cmp.error(outer, fmt.Sprintf("error during macroexpansion: %v", err))
-						} else {
+						if newForm, ok := cmp.expandMacro(outer, form, sym); ok {
 							stmt = newForm
 							continue
 						}
@@ -1465,6 +1760,7 @@ func (cmp *compiler) compileIfStatement(result []byte, form *list.Pair) []byte {
 	stmt := form.ToSlice()
 	if len(stmt) < 3 || len(stmt) > 4 {
 		cmp.error(form, "invalid if statement")
+		return result
 	}
 	result = append(result, "if "...)
 	result = cmp.compileExpression(result, form, stmt[1])
@@ -1481,9 +1777,15 @@ func (cmp *compiler) compileIfStarStatement(result []byte, form *list.Pair) []by
 	stmt := form.ToSlice()
 	if len(stmt) < 4 || len(stmt) > 5 {
 		cmp.error(form, "invalid if* statement")
+		return result
+	}
+	simple, ok := stmt[1].(*list.Pair)
+	if !ok {
+		cmp.error(form, fmt.Sprintf("invalid simple statement %v in if* statement", stmt[1]))
+		return result
 	}
 	result = append(result, "if "...)
-	result = cmp.compileSimpleStatement(result, stmt[1].(*list.Pair))
+	result = cmp.compileSimpleStatement(result, simple)
 	if result[len(result)-1] != '\n' {
 		result = append(result, ';', ' ')
 	}
@@ -1500,6 +1802,8 @@ func (cmp *compiler) compileIfStarStatement(result []byte, form *list.Pair) []by
 func (cmp *compiler) compileFallthroughStatement(result []byte, form *list.Pair) []byte {
 	if form.Cdr != list.Nil() {
 		cmp.error(form, "invalid fallthrough statement")
+	} else if form != cmp.fallthroughStmt {
+		cmp.error(form, "fallthrough statement out of place")
 	}
 	return append(result, "fallthrough\n"...)
 }
@@ -1509,7 +1813,7 @@ func (cmp *compiler) compileReturnStatement(result []byte, form *list.Pair) []by
 	if len(stmt) > 2 {
 		cmp.error(form, "invalid number of return values")
 	}
-	if len(stmt) == 0 {
+	if len(stmt) == 1 {
 		return append(result, "return\n"...)
 	}
 	result = append(result, "return "...)
@@ -1521,6 +1825,7 @@ func (cmp *compiler) compileDelayedStatement(result []byte, form *list.Pair) []b
 	del := form.ToSlice()
 	if len(del) != 2 {
 		cmp.error(form, fmt.Sprintf("invalid statement %v", form))
+		return result
 	}
 	result = append(result, del[0].(*lib.Symbol).Identifier...)
 	result = append(result, ' ')
@@ -1538,7 +1843,7 @@ func (cmp *compiler) compileJumpStatement(result []byte, form *list.Pair) []byte
 	}
 	result = append(result, stmt[0].(*lib.Symbol).Identifier...)
 	if len(stmt) == 2 {
-		if label, ok := stmt[1].(*lib.Symbol); !ok || !isValidSimpleIdentifier(label) || label.Identifier == "_" {
+		if label, ok := stmt[1].(*lib.Symbol); !ok || !ast.ValidSimpleIdentifier(label) || label.Identifier == "_" {
 			cmp.error(form, fmt.Sprintf("invalid jump target %v", stmt[1]))
 		} else {
 			result = append(result, ' ')
@@ -1552,6 +1857,7 @@ func (cmp *compiler) compileStructLiteral(result []byte, form *list.Pair) []byte
 	expr := form.ToSlice()
 	if len(expr) < 2 || len(expr)%2 == 1 {
 		cmp.error(form, "invalid struct literal")
+		return result
 	}
 	result = append(result, '(')
 	result = cmp.compileType(result, form, expr[1])
@@ -1559,7 +1865,7 @@ func (cmp *compiler) compileStructLiteral(result []byte, form *list.Pair) []byte
 	for i := 2; i < len(expr); i += 2 {
 		switch s := expr[i].(type) {
 		case *lib.Symbol:
-			if !isValidSimpleIdentifier(s) {
+			if !ast.ValidSimpleIdentifier(s) {
 				cmp.error(form, fmt.Sprintf("invalid key %v in struct literal", s))
 			}
 			result = append(result, s.Identifier...)
@@ -1577,12 +1883,13 @@ func (cmp *compiler) compileVectorLiteral(result []byte, kind string, form *list
 	expr := form.ToSlice()
 	if len(expr) < 2 {
 		cmp.error(form, fmt.Sprintf("invalid %v literal", kind))
+		return result
 	}
 	result = append(result, '(')
 	result = cmp.compileType(result, form, expr[1])
 	result = append(result, '{')
-	for i := 2; i < len(expr); i++ {
-		result = cmp.compileExpression(result, form, expr[i])
+	for _, element := range cmp.spliceExpressions(form, expr[2:]) {
+		result = cmp.compileExpression(result, form, element)
 		result = append(result, ',', ' ')
 	}
 	return append(result, '}', ')')
@@ -1592,6 +1899,7 @@ func (cmp *compiler) compileMapLiteral(result []byte, form *list.Pair) []byte {
 	expr := form.ToSlice()
 	if len(expr) < 2 || len(expr)%2 == 1 {
 		cmp.error(form, "invalid map literal")
+		return result
 	}
 	result = append(result, '(')
 	result = cmp.compileType(result, form, expr[1])
@@ -1618,7 +1926,9 @@ func (cmp *compiler) compileFuncLiteral(result []byte, form *list.Pair) []byte {
 	if !ok {
 		cmp.error(form, "missing parameter list in function literal")
 	} else {
-		result = cmp.compileParameters(result, first, true)
+		params := cmp.parser.Fields(first, true)
+		cmp.declareParameters(params)
+		result = cmp.compileFields(result, params)
 		result = append(result, ' ')
 		rest = rest.Cdr.(*list.Pair)
 	}
@@ -1631,7 +1941,9 @@ func (cmp *compiler) compileFuncLiteral(result []byte, form *list.Pair) []byte {
 	if !ok {
 		cmp.error(form, "missing result list in function literal")
 	} else if first != list.Nil() {
-		result = cmp.compileParameters(result, first, false)
+		results := cmp.parser.Fields(first, false)
+		cmp.declareParameters(results)
+		result = cmp.compileFields(result, results)
 		result = append(result, ' ')
 		rest = rest.Cdr.(*list.Pair)
 	}
@@ -1643,12 +1955,13 @@ func (cmp *compiler) compileSlotExpression(result []byte, form *list.Pair) []byt
 	expr := form.ToSlice()
 	if len(expr) != 3 {
 		cmp.error(form, "invalid slot expression")
+		return result
 	}
 	result = cmp.compileExpression(result, form, expr[1])
 	result = append(result, '.')
 	switch s := expr[2].(type) {
 	case *lib.Symbol:
-		if !isValidSimpleIdentifier(s) {
+		if !ast.ValidSimpleIdentifier(s) {
 			cmp.error(form, fmt.Sprintf("invalid selector %v in slot expression", s))
 		}
 		return append(result, s.Identifier...)
@@ -1662,6 +1975,7 @@ func (cmp *compiler) compileIndexExpression(result []byte, form *list.Pair) []by
 	expr := form.ToSlice()
 	if len(expr) != 3 {
 		cmp.error(form, "invalid index expression")
+		return result
 	}
 	result = cmp.compileExpression(result, form, expr[1])
 	result = append(result, '[')
@@ -1673,6 +1987,7 @@ func (cmp *compiler) compileSliceExpression(result []byte, form *list.Pair) []by
 	expr := form.ToSlice()
 	if len(expr) < 3 || len(expr) > 5 {
 		cmp.error(form, "invalid slice expression")
+		return result
 	}
 	result = cmp.compileExpression(result, form, expr[1])
 	result = append(result, '[')
@@ -1694,6 +2009,7 @@ func (cmp *compiler) compileAssertExpression(result []byte, form *list.Pair) []b
 	expr := form.ToSlice()
 	if len(expr) != 3 {
 		cmp.error(form, "invalid type assertion")
+		return result
 	}
 	result = cmp.compileExpression(result, form, expr[1])
 	result = append(result, '.', '(')
@@ -1705,25 +2021,83 @@ func (cmp *compiler) compileConvertExpression(result []byte, form *list.Pair) []
 	expr := form.ToSlice()
 	if len(expr) != 3 {
 		cmp.error(form, "invalid type conversion")
+		return result
+	}
+	typ := cmp.compileType(nil, form, expr[2])
+	if needsParentheses(typ) {
+		result = append(result, '(')
+		result = append(result, typ...)
+		result = append(result, ')')
+	} else {
+		result = append(result, typ...)
 	}
 	result = append(result, '(')
-	result = cmp.compileType(result, form, expr[2])
-	result = append(result, ')', '(')
-	result = cmp.compileExpression(result, form, expr[1])
+	if isBinaryOperation(expr[1]) {
+		// the parentheses of the conversion already delimit the operation
+		start := len(result)
+		result = cmp.compileExpression(result, form, expr[1])
+		if len(result) > start+1 && result[start] == '(' && result[len(result)-1] == ')' {
+			result = append(result[:start], result[start+1:len(result)-1]...)
+		}
+	} else {
+		result = cmp.compileExpression(result, form, expr[1])
+	}
 	return append(result, ')')
 }
 
+// needsParentheses reports whether the type in a conversion must be
+// parenthesized, because it starts with an operator or contains a function
+// type. Without parentheses, a function type at the end of the type would
+// take the conversion as its result list.
+func needsParentheses(typ []byte) bool {
+	return bytes.HasPrefix(typ, []byte("*")) || bytes.HasPrefix(typ, []byte("<-")) ||
+		bytes.Contains(typ, []byte("func ")) || bytes.Contains(typ, []byte("func("))
+}
+
+// isBinaryOperation reports whether element is an operator expression
+// with more than one operand, which compileOperatorExpression encloses
+// in parentheses.
+func isBinaryOperation(element interface{}) bool {
+	e, ok := element.(*list.Pair)
+	if !ok || e == nil || !list.IsProper(e) || e.Length() < 3 {
+		return false
+	}
+	switch e.Car {
+	case _plus, _minus, _mul, _div, _rem, _and, _and_not, _or, _xor, _shl, _shr, _bool_and, _bool_or,
+		_equal_equal, _not_equal, _less, _less_equal, _greater, _greater_equal:
+		return true
+	}
+	return false
+}
+
+// startsWithOperator reports whether the compiled expression starts with
+// a unary operator, which could merge with a preceding unary operator into
+// a different token, like - - into --, or & & into &&.
+func startsWithOperator(expr []byte) bool {
+	return len(expr) > 0 && bytes.IndexByte([]byte("+-!^*&<"), expr[0]) >= 0
+}
+
 func (cmp *compiler) compileOperatorExpression(result []byte, form *list.Pair) []byte {
 	expr := form.ToSlice()
 	if len(expr) < 2 {
 		cmp.error(form, "invalid operator expression")
+		return result
 	}
 	if len(expr) == 2 {
 		// unary expression
 		switch expr[0] {
 		case _plus, _minus, _bang, _xor, _ptr, _address, _arrow_left:
+			if expr[0] == _arrow_left {
+				cmp.checkReceive(form, expr[1])
+			}
 			result = append(result, expr[0].(*lib.Symbol).Identifier...)
-			return cmp.compileExpression(result, form, expr[1])
+			operand := cmp.compileExpression(nil, form, expr[1])
+			if startsWithOperator(operand) {
+				result = append(result, '(')
+				result = append(result, operand...)
+				return append(result, ')')
+			}
+			return append(result, operand...)
 		default:
 			cmp.error(form, fmt.Sprintf("invalid operator %v in unary expression", expr[0]))
 			return result
@@ -1744,6 +2118,7 @@ func (cmp *compiler) compileOperatorExpression(result []byte, form *list.Pair) [
 	case _equal_equal, _not_equal, _less, _less_equal, _greater, _greater_equal:
 		if len(expr) != 3 {
 			cmp.error(form, "invalid operator expression")
+			return result
 		}
 		result = append(result, '(')
 		result = cmp.compileExpression(result, form, expr[1])
@@ -1764,23 +2139,36 @@ func (cmp *compiler) compileCallExpression(result []byte, form *list.Pair) []byt
 		cmp.error(form, "invalid call expression")
 	}
 	result = cmp.compileExpression(result, form, expr[0])
-	if len(expr) == 1 {
-		return append(result, '(', ')')
-	}
+	args := cmp.spliceExpressions(form, expr[1:])
 	result = append(result, '(')
-	result = cmp.compileExpression(result, form, expr[1])
-	if len(expr) > 2 {
-		lastIndex := len(expr) - 1
-		for i := 2; i < lastIndex; i++ {
+	for i, arg := range args {
+		final := i == len(args)-1
+		if arg == _ellipsis {
+			if i == 0 {
+				cmp.error(form, "... without a preceding argument")
+			} else if !final {
+				cmp.error(form, "... is not the final argument")
+			}
+			result = append(result, '.', '.', '.')
+			continue
+		}
+		if i > 0 {
 			result = append(result, ',', ' ')
-			result = cmp.compileExpression(result, form, expr[i])
 		}
-		if expr[lastIndex] == _ellipsis {
+		if e, ok := arg.(*list.Pair); ok && e != nil && (e.Car == _spread || e.Car == _ellipsis) {
+			spread := e.ToSlice()
+			if len(spread) != 2 {
+				cmp.error(e, fmt.Sprintf("invalid %v argument", e.Car))
+				continue
+			}
+			if !final {
+				cmp.error(e, fmt.Sprintf("%v argument is not the final argument", e.Car))
+			}
+			result = cmp.compileExpression(result, form, spread[1])
 			result = append(result, '.', '.', '.')
-		} else {
-			result = append(result, ',', ' ')
-			result = cmp.compileExpression(result, form, expr[lastIndex])
+			continue
 		}
+		result = cmp.compileExpression(result, form, arg)
 	}
 	if l := len(result) - 1; result[l] == '\n' {
 		result = append(result[:l], ',', '\n')
@@ -1789,21 +2177,50 @@ func (cmp *compiler) compileCallExpression(result []byte, form *list.Pair) []byt
 }
 
 func (cmp *compiler) compileMakeExpression(result []byte, form *list.Pair) []byte {
-	result = append(result, "make("...)
 	rest := form.Cdr.(*list.Pair)
+	if rest == list.Nil() {
+		cmp.error(form, "invalid make expression")
+		return result
+	}
+	result = append(result, "make("...)
 	result = cmp.compileType(result, form, rest.Car)
-	rest.Cdr.(*list.Pair).ForEach(func(element interface{}) {
+	for _, element := range cmp.spliceExpressions(form, rest.Cdr.(*list.Pair).ToSlice()) {
 		result = append(result, ',', ' ')
 		result = cmp.compileExpression(result, form, element)
-	})
+	}
 	return append(result, ')')
 }
 
+// expandMacro expands the invocation e of the macro sym, reporting
+// errors at form.
+func (cmp *compiler) expandMacro(form, e *list.Pair, sym *lib.Symbol) (interface{}, bool) {
+	file, ok := cmp.pluginFile(form, sym.Package)
+	if !ok {
+		return nil, false
+	}
+	p, ok := cmp.openPlugin(form, file)
+	if !ok || !cmp.checkMacroInvocation(form, e, sym, p) {
+		return nil, false
+	}
+	macroFn, err := p.lookupMacro(sym.Identifier)
+	if err != nil {
+		cmp.error(form, "invalid macro invocation")
+		return nil, false
+	}
+	newForm, err := cmp.expand(file, sym.Identifier, macroFn, e)
+	if err != nil {
+		cmp.macroError(form, "error during macroexpansion", err)
+		return nil, false
+	}
+	return newForm, true
+}
+
 func (cmp *compiler) compileExpr(result []byte, form *list.Pair, element interface{}, operatorAllowed bool) []byte {
+	source := form
 	for {
 		switch e := element.(type) {
 		case *lib.Symbol:
-			sym := cmp.encloseSymbol(e)
+			sym := cmp.encloseSymbol(source, e)
 			if !isValidIdentifier(sym) {
 				cmp.error(form, fmt.Sprintf("Invalid identifier %v.", sym))
 			}
@@ -1824,12 +2241,16 @@ func (cmp *compiler) compileExpr(result []byte, form *list.Pair, element interfa
 			return append(result, fmt.Sprintf("%q", e)...)
 		case *list.Pair:
 			if e == nil {
-				sym := cmp.encloseSymbol(lib.Intern("github.com/pcostanza/slick/list", "Nil"))
+				sym := cmp.encloseSymbol(nil, lib.Intern("github.com/pcostanza/slick/list", "Nil"))
 				result = append(result, sym.Package...)
 				result = append(result, '.')
 				result = append(result, sym.Identifier...)
 				return append(result, '(', ')')
 			}
+			if !list.IsProper(e) {
+				cmp.error(form, fmt.Sprintf("Invalid expression %v.", e))
+				return result
+			}
 			switch e.Car {
 			case _make:
 				return cmp.compileMakeExpression(result, e)
@@ -1853,14 +2274,32 @@ func (cmp *compiler) compileExpr(result []byte, form *list.Pair, element interfa
 				return cmp.compileAssertExpression(result, e)
 			case _convert:
 				return cmp.compileConvertExpression(result, e)
+			case _if_expr:
+				return cmp.compileIfExpression(result, e)
 			case _values:
-				rest := e.Cdr.(*list.Pair)
-				result = cmp.compileExpr(result, form, rest.Car, operatorAllowed)
-				rest.Cdr.(*list.Pair).ForEach(func(element interface{}) {
+				values := cmp.spliceExpressions(e, e.Cdr.(*list.Pair).ToSlice())
+				if len(values) == 0 {
+					cmp.error(e, "invalid values expression")
+					return result
+				}
+				result = cmp.compileExpr(result, form, values[0], operatorAllowed)
+				for _, value := range values[1:] {
 					result = append(result, ',', ' ')
-					result = cmp.compileExpr(result, form, element, operatorAllowed)
-				})
+					result = cmp.compileExpr(result, form, value, operatorAllowed)
+				}
 				return result
+			case _splice:
+				body, ok := cmp.spliceBody(e)
+				if !ok {
+					return result
+				}
+				exprs := cmp.spliceExpressions(e, body.ToSlice())
+				if len(exprs) != 1 {
+					cmp.error(e, fmt.Sprintf("splice of %v expressions in single-expression context", len(exprs)))
+					return result
+				}
+				element = exprs[0]
+				continue
 			case _plus, _minus, _mul, _div, _rem, _bang, _xor, _and, _and_not, _or, _shl, _shr, _arrow_left,
 				_bool_and, _bool_or, _equal_equal, _not_equal, _less, _less_equal, _greater, _greater_equal:
 				if !operatorAllowed {
@@ -1870,37 +2309,41 @@ func (cmp *compiler) compileExpr(result []byte, form *list.Pair, element interfa
 			default:
 				if sym, ok := e.Car.(*lib.Symbol); ok {
 					switch sym {
-					case _quote, _quasiquote, _unquote, _unquote_splicing:
-						p := cmp.resolveLibPlugin()
-						var macroSym plugin.Symbol
-						var err error
-						switch sym {
-						case _quote:
-							macroSym, err = p.Lookup("Quote")
-						case _quasiquote:
-							macroSym, err = p.Lookup("Quasiquote")
-						case _unquote:
-							macroSym, err = p.Lookup("Unquote")
-						case _unquote_splicing:
-							macroSym, err = p.Lookup("UnquoteSplicing")
+					case _quote:
+						if name, ok := cmp.pooledTemplate(e); ok {
+							return formatIdentifier(result, name)
+						}
+						file, ok := cmp.libPlugin(form)
+						if !ok {
+							return result
+						}
+						p, ok := cmp.openPlugin(form, file)
+						if !ok {
+							return result
 						}
-						if err != nil {
+						if macroFn, err := p.lookupMacro("Quote"); err != nil {
 							cmp.error(form, "invalid special form")
-						} else if newForm, err := macroSym.(macro)(e, Environment{}); err != nil {
-							cmp.error(form, fmt.Sprintf("error during special form processing: %v", err))
+						} else if newForm, err := cmp.expand(file, "Quote", macroFn, e); err != nil {
+							cmp.macroError(form, "error during special form processing", err)
+						} else if datum, ok := list.Cadr(e).(*list.Pair); ok && datum != nil && !cmp.pool.active {
+							return formatIdentifier(result, cmp.poolQuoted(form, e, datum, newForm))
 						} else {
 							element = newForm
 							continue
 						}
+					case _quasiquote:
+						element = cmp.expandQuasiquote(e)
+						continue
+					case _unquote, _unquote_splicing:
+						cmp.error(e, fmt.Sprintf("%v outside of quasiquote", sym))
+						return result
+					case _spread, _ellipsis:
+						cmp.error(e, fmt.Sprintf("%v form outside of call arguments", sym))
+						return result
 					}
 					if len(sym.Package) > 0 && sym.Package[0] == '#' {
-						p := cmp.resolvePlugin(sym.Package)
-						if macroSym, err := p.Lookup(sym.Identifier); err != nil {
-							cmp.error(form, "invalid macro invocation")
-						} else if newForm, err := macroSym.(macro)(e, Environment{}); err != nil {
-							cmp.error(form, fmt.Sprintf("error during macroexpansion: %v", err))
-						} else {
-							element = newForm
+						if newForm, ok := cmp.expandMacro(form, e, sym); ok {
+							element, source = newForm, nil
 							continue
 						}
 					}
@@ -1922,11 +2365,50 @@ func (cmp *compiler) compilePrimaryExpression(result []byte, form *list.Pair, el
 	return cmp.compileExpr(result, form, element, false)
 }
 
-func (cmp *compiler) compileFile() []byte {
+// Output buffers are reused across compilations, which reduces garbage
+// when many files are compiled in one process.
+var buffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func getBuffer() []byte {
+	return (*buffers.Get().(*[]byte))[:0]
+}
+
+func putBuffer(buf []byte) {
+	buffers.Put(&buf)
+}
+
+// An output collects the generated code for Config.Compile. When the
+// whole body is in memory, compileFile hands its buffer over to the
+// output instead of writing it.
+type output struct {
+	code []byte
+}
+
+func (out *output) Write(buf []byte) (int, error) {
+	out.code = append(out.code, buf...)
+	return len(buf), nil
+}
+
+// compileFile compiles the file into a header with the package clause and
+// the imports, and a body with the remaining declarations. Since imports
+// are added while the body is compiled, they are collected in cmp.imports
+// and only added to the header at the end, before both are written to w.
+func (cmp *compiler) compileFile(w io.Writer) error {
+	var result []byte
+	var stream declStream
 	defer func() {
+		stream.close()
+		putBuffer(cmp.header)
+		putBuffer(result)
 		cmp.header = nil
+		cmp.imports = nil
+		cmp.definitions = nil
+		cmp.quoted = nil
+		cmp.local = false
+		cmp.emitted = nil
+		cmp.pool = quotedPool{}
 	}()
-	cmp.header = cmp.compilePackageClause()
+	cmp.header = cmp.compilePackageClause(getBuffer())
 
 	if cmp.reader.Errors.Len() != 0 {
 		return nil
@@ -1953,10 +2435,20 @@ func (cmp *compiler) compileFile() []byte {
 		form, ok = element.(*list.Pair)
 	}
 
-	var result []byte
+	result = getBuffer()
 
 	for ok && form != nil {
+		cmp.expansions = 0
+		cmp.channels = nil
+		result = cmp.markLine(result, form)
 		result = cmp.compileDecl(result, form)
+		result = cmp.compileEmittedDecls(result)
+		if cmp.config.Stream {
+			var err error
+			if result, err = cmp.flush(&stream, result); err != nil {
+				return err
+			}
+		}
 		cmp.reader.SkipSpace()
 		offset = cmp.reader.Offset()
 		element = cmp.reader.Read()
@@ -1966,7 +2458,7 @@ func (cmp *compiler) compileFile() []byte {
 		form, ok = element.(*list.Pair)
 	}
 
-	if !ok {
+	if !ok && element != io.EOF {
 		cmp.reader.Error(offset, "invalid top-level form ")
 	}
 
@@ -1974,23 +2466,49 @@ func (cmp *compiler) compileFile() []byte {
 		return nil
 	}
 
-	cmp.header = append(cmp.header, '\n')
-	result = append(cmp.header, result...)
-	return result
+	cmp.header = cmp.compileImports(cmp.header)
+	write := func(buf []byte) error {
+		_, err := w.Write(buf)
+		return err
+	}
+	if cmp.config.AlignLines {
+		aligner := lineAligner{w: w, line: 1}
+		write = aligner.write
+	}
+	if out, ok := w.(*output); ok && !cmp.config.AlignLines && stream.file == nil {
+		// Move the body up to make room for the header, and hand the
+		// buffer over, instead of copying it.
+		n := len(cmp.header)
+		result = append(result, cmp.pool.decls...)
+		result = append(result, cmp.header...)
+		copy(result[n:], result[:len(result)-n])
+		copy(result, cmp.header)
+		out.code, result = result, nil
+		return nil
+	}
+	if err := write(cmp.header); err != nil {
+		return err
+	}
+	if err := stream.copyTo(write); err != nil {
+		return err
+	}
+	for _, buf := range [][]byte{result, cmp.pool.decls} {
+		if err := write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Compile compiles the source file read by rd with the default
+// configuration, and returns the resulting Go code.
 func Compile(rd *reader.Reader) (result []byte, err error) {
-	var cmp compiler
-	defer func() {
-		e := recover()
-		if e == nil {
-			return
-		}
-		if _, ok := e.(bailout); !ok {
-			panic(e)
-		}
-		err = cmp.reader.Errors.Err()
-	}()
-	cmp.init(rd)
-	return cmp.compileFile(), cmp.reader.Errors.Err()
+	return Config{}.Compile(rd)
+}
+
+// CompileTo compiles the source file read by rd with the default
+// configuration, and writes the resulting Go code to w. Nothing is
+// written if the source file contains errors.
+func CompileTo(rd *reader.Reader, w io.Writer) error {
+	return Config{}.CompileTo(rd, w)
 }
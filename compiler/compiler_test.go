@@ -0,0 +1,1177 @@
+package compiler_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/build"
+	"go/format"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/pcostanza/slick/compiler"
+	"github.com/pcostanza/slick/reader"
+)
+
+func compile(t *testing.T, src string) string {
+	t.Helper()
+	return compileWith(t, compiler.Config{}, src)
+}
+
+func compileWith(t *testing.T, config compiler.Config, src string) string {
+	t.Helper()
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Compile(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formatted, err := format.Source(result)
+	if err != nil {
+		t.Fatalf("invalid Go code: %v\n%s", err, result)
+	}
+	return string(formatted)
+}
+
+func compact(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func expectContains(t *testing.T, src string, fragments ...string) {
+	t.Helper()
+	expectContainsWith(t, compiler.Config{}, src, fragments...)
+}
+
+func expectContainsWith(t *testing.T, config compiler.Config, src string, fragments ...string) {
+	t.Helper()
+	result := compileWith(t, config, src)
+	for _, fragment := range fragments {
+		if !strings.Contains(compact(result), compact(fragment)) {
+			t.Errorf("%q not found in:\n%s", fragment, result)
+		}
+	}
+}
+
+func expectError(t *testing.T, src string) {
+	t.Helper()
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiler.Compile(rd); err == nil {
+		t.Errorf("no error for %s", src)
+	}
+}
+
+func TestAnonymousTypes(t *testing.T) {
+	t.Run("Struct parameter", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((p (struct ((x y) :type int) (z :type string :tag "json:\"z\"")))) ())`,
+			"func f(p struct { x, y int\nz string `json:\"z\"` })")
+	})
+	t.Run("Interface parameter", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((s (interface (String () ((_ string)))))) ())`,
+			"func f(s interface { String() (_ string) })")
+	})
+	t.Run("Struct and interface results", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f () ((a (struct (ok :type bool))) (b (interface)))
+  (return))`,
+			"func f() (a struct { ok bool }, b interface{})")
+	})
+	t.Run("Embedded fields", func(t *testing.T) {
+		expectContains(t, `(package p)
+(import "io")
+(func f ((r (struct (io:Reader) ((* io:Writer)) (n :type int :documentation "count")))) ())`,
+			"func f(r struct { io.Reader\n*io.Writer\n// count\nn int })")
+	})
+	t.Run("Embedded interfaces and documentation", func(t *testing.T) {
+		expectContains(t, `(package p)
+(import "io")
+(func f ((r (interface (io:Reader :documentation "reader") (Close) (Name () ((_ string)) "name")))) ())`,
+			"func f(r interface {\n// reader\nio.Reader\nClose()\n// name\nName() (_ string) })")
+	})
+	t.Run("Map keys", func(t *testing.T) {
+		expectContains(t, `(package p)
+(var (m :type (map (struct (k :type string)) (interface))))`,
+			"var m map[struct{ k string }]interface{}")
+	})
+	t.Run("Channel elements", func(t *testing.T) {
+		expectContains(t, `(package p)
+(var (c :type (chan (struct))) (d :type (<-chan (interface (Close)))))`,
+			"c chan struct{}",
+			"d <-chan interface{ Close() }")
+	})
+	t.Run("Invalid struct entry", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((p (struct (x :type)))) ())`)
+	})
+}
+
+func TestInitDeclarations(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		expectContains(t, `(package p) (init)`, "func init() {}")
+	})
+	t.Run("Documentation", func(t *testing.T) {
+		expectContains(t, `(package p) (init "Sets up the table.")`, "// Sets up the table.\nfunc init() {}")
+	})
+	t.Run("Several", func(t *testing.T) {
+		expectContains(t, `(package p)
+(var (table :type (map string int)))
+(init "Sets up the table."
+  (= table (make (map string int)))
+  (= (at table "a") 1))
+(init (print table))`,
+			"// Sets up the table.\nfunc init() {\ntable = make(map[string]int)\ntable[\"a\"] = 1\n}",
+			"func init() {\nprint(table)\n}")
+	})
+	t.Run("Invalid statements", func(t *testing.T) {
+		expectError(t, `(package p) (init 1)`)
+		expectError(t, `(package p) (init "Doc." "More doc.")`)
+		expectError(t, `(package p) (init (var))`)
+	})
+}
+
+func TestReturnStatements(t *testing.T) {
+	t.Run("Without results", func(t *testing.T) {
+		expectContains(t, `(package p) (func f () () (print 1) (return))`, "print(1)\nreturn\n}")
+	})
+	t.Run("Named results", func(t *testing.T) {
+		expectContains(t, `(package p) (func f () ((x int)) (= x 1) (return))`, "x = 1\nreturn\n}")
+	})
+	t.Run("Result", func(t *testing.T) {
+		expectContains(t, `(package p) (func f () ((_ int)) (return 1))`, "return 1\n}")
+	})
+	t.Run("Several results", func(t *testing.T) {
+		expectContains(t, `(package p) (func f () ((_ int) (_ int)) (return (values 1 2)))`, "return 1, 2\n}")
+	})
+	t.Run("Too many results", func(t *testing.T) {
+		expectError(t, `(package p) (func f () ((_ int) (_ int)) (return 1 2))`)
+	})
+}
+
+func TestSpreadArguments(t *testing.T) {
+	t.Run("Trailing ellipsis", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((xs ... int)) ())
+(func g ((xs (slice int))) () (f xs ...))`,
+			"func f(xs ...int)",
+			"f(xs...)")
+	})
+	t.Run("Spread", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int) (xs ... int)) ())
+(func g ((xs (slice int))) () (f 1 (spread (append xs 2))))`,
+			"f(1, append(xs, 2)...)")
+	})
+	t.Run("Ellipsis form", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((xs ... int)) ())
+(func g ((xs (slice int))) () (f (... (slice xs 1))))`,
+			"f(xs[1:]...)")
+	})
+	t.Run("Spliced spread", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int) (xs ... int)) ())
+(func g ((xs (slice int))) () (f (splice 1 (spread xs))))`,
+			"f(1, xs...)")
+	})
+	t.Run("Spread not final", func(t *testing.T) {
+		expectError(t, `(package p)
+(func g ((xs (slice int))) () (f (spread xs) 1))`)
+	})
+	t.Run("Ellipsis not final", func(t *testing.T) {
+		expectError(t, `(package p)
+(func g ((xs (slice int))) () (f xs ... 1))`)
+	})
+	t.Run("Ellipsis without argument", func(t *testing.T) {
+		expectError(t, `(package p)
+(func g () () (f ...))`)
+	})
+	t.Run("Spread outside call", func(t *testing.T) {
+		expectError(t, `(package p)
+(func g ((xs (slice int))) () (:= y (spread xs)))`)
+	})
+}
+
+func TestSelect(t *testing.T) {
+	t.Run("Communication cases", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((ch (chan int)) (x int)) ()
+  (select
+    ((:= (v ok) (<- ch)) (print v ok))
+    ((= x (<- ch)))
+    ((<- ch))
+    ((-> ch 2))
+    (default)))`,
+			"case v, ok := <-ch:",
+			"case x = <-ch:",
+			"case <-ch:",
+			"case ch <- 2:",
+			"default:")
+	})
+	t.Run("Send to receive-only channel", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((ch (<-chan int))) ()
+  (select ((-> ch 2))))`)
+	})
+	t.Run("Receive from send-only channel", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((ch (chan<- int))) ()
+  (select ((:= v (<- ch)))))`)
+	})
+	t.Run("Inferred channel direction", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f () ()
+  (:= ch (make (<-chan int)))
+  (-> ch 1))`)
+	})
+	t.Run("Redeclared channel", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((ch (chan<- int))) ()
+  (func ((ch (chan int))) () (select ((<- ch)))))`,
+			"case <-ch:")
+	})
+	t.Run("Too many variables", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((ch (chan int))) ()
+  (select ((:= (v ok z) (<- ch)))))`)
+	})
+	t.Run("No communication", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((ch (chan int))) ()
+  (select ((:= v ch))))`)
+	})
+}
+
+func TestSwitch(t *testing.T) {
+	t.Run("Fallthrough", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) (print 0) (fallthrough))
+    ((1) :L (fallthrough))
+    (default (print 1))))`,
+			"case 0:\nprint(0)\nfallthrough\ncase 1:",
+			"L:\nfallthrough\ndefault:")
+	})
+	t.Run("Case guards", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int) (v (interface))) ()
+  (switch x
+    ((0 1) :when (> x 0) (print x)))
+  (type-switch y v
+    ((int) :when (> y 0) (print y))
+    (default)))`,
+			"case 0, 1:\nif x > 0 {\nprint(x)\n}",
+			"case int:\nif y > 0 {\nprint(y)\n}")
+	})
+	t.Run("False case guard", func(t *testing.T) {
+		// The guard is checked inside the selected case, so that a false
+		// guard leaves the switch without trying the default case.
+		expectContains(t, `(package p)
+(func f ((x int) (y int)) ()
+  (switch x
+    ((0 1) :when (> y 0) (print 1))
+    (default (print 2))))`,
+			"case 0, 1:\nif y > 0 {\nprint(1)\n}\ndefault:\nprint(2)")
+	})
+	t.Run("Fallthrough into guarded case", func(t *testing.T) {
+		_, err := compileResult(t, compiler.Config{}, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) (fallthrough))
+    ((1) :when true (print 1))
+    (default)))`)
+		if err == nil || !strings.Contains(err.Error(), "test.slick:4:10: fallthrough statement into guarded case") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Fallthrough not last", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) (fallthrough) (print 0))
+    (default)))`)
+	})
+	t.Run("Fallthrough in final case", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) (fallthrough))))`)
+	})
+	t.Run("Fallthrough in guarded case", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) :when true (fallthrough))
+    (default)))`)
+	})
+	t.Run("Fallthrough in type switch", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((v (interface))) ()
+  (type-switch _ v
+    ((int) (fallthrough))
+    (default)))`)
+	})
+	t.Run("Nested fallthrough", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (switch x
+    ((0) (if true (fallthrough)))
+    (default)))`)
+	})
+}
+
+func TestConstGroups(t *testing.T) {
+	t.Run("Typed iota", func(t *testing.T) {
+		expectContains(t, `(package p)
+(type (Weekday int))
+(const
+  (Sunday :type Weekday := iota)
+  Monday
+  (Tuesday)
+  ((bit0 mask0) := (values (<< 1 iota) (- (<< 1 iota) 1)))
+  ((bit1 mask1))
+  ((_ _)))`,
+			"Sunday Weekday = iota\nMonday\nTuesday\n",
+			"bit0, mask0 = (1 << iota), ((1 << iota) - 1)\nbit1, mask1\n_, _\n")
+	})
+	for _, src := range []string{
+		`(package p) (const ((a b) := (values 1 2)) c)`,
+		`(package p) (const (a := 1) ((b c)))`,
+		`(package p) (const ((a b) := 1))`,
+		`(package p) (const (a := (values 1 2)))`,
+		`(package p) (const (a :type int := iota) (b :type int))`,
+		`(package p) (var ((a b) := 1))`,
+	} {
+		expectError(t, src)
+	}
+}
+
+func TestRangeClauses(t *testing.T) {
+	t.Run("Iteration variables", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((xs (slice int)) (m (map string int)) (ch (chan int))) ()
+  (var (k :type string))
+  (range (:= (i x) xs) (print i x))
+  (range (:= (_ x) xs) (print x))
+  (range (:= (i _) xs) (print i))
+  (range (= k m) (print k))
+  (range (= (values k _) m) (print k))
+  (range (:= v ch) (print v))
+  (range (:= _ ch))
+  (range (:= () xs))
+  (range (ch)))`,
+			"for i, x := range xs {",
+			"for _, x := range xs {",
+			"for i := range xs {",
+			"for k = range m {",
+			"for k = range m {",
+			"for v := range ch {",
+			"for range ch {}",
+			"for range xs {}",
+			"for range ch {}")
+	})
+	for _, src := range []string{
+		`(package p) (func f ((xs (slice int))) () (range (:= (a b c) xs)))`,
+		`(package p) (func f ((ch (chan int))) () (range (:= (a b) ch)))`,
+		`(package p) (func f ((ch (chan<- int))) () (range (ch)))`,
+		`(package p) (func f ((xs (slice int))) () (range (xs 1)))`,
+		`(package p) (func f ((xs (slice int))) () (range (:= a)))`,
+	} {
+		expectError(t, src)
+	}
+}
+
+func TestForStatements(t *testing.T) {
+	t.Run("Post statements", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f () ()
+  (for ((:= i 0) (< i 3) (++ i)) (print i))
+  (var (j := 0))
+  (for (() true (= j 1)) (print)))`,
+			"for i := 0; i < 3; i++ {\nprint(i)\n}",
+			"for ; true; j = 1 {")
+	})
+}
+
+func TestLoopLabels(t *testing.T) {
+	t.Run("Labeled loops", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((rows (slice (slice int)))) ()
+  (for :Outer ((:= i 0) (< i 3) (++ i))
+    (range :Inner (:= (_ x) (at rows i))
+      (if (< x 0) (continue Outer))
+      (if (> x 9) (break Inner))))
+  (while :Retry true
+    :Forever (loop
+      (break Retry)
+      (continue Forever))))`,
+			"Outer:\nfor i := 0; i < 3; i++ {",
+			"Inner:\nfor _, x := range rows[i] {",
+			"Retry:\nfor true {",
+			"Forever:\nfor {")
+	})
+	t.Run("Statements after loops", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((xs (slice int))) ((s int))
+  (range (:= (_ x) xs) (+= s x))
+  (loop (break))
+  (return))`,
+			"}\nfor {\nbreak\n}\nreturn")
+	})
+	t.Run("Keyword labels in loop bodies", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f () ()
+  (loop :again (print 1) (goto again)))`,
+			"for {\nagain:\nprint(1)\ngoto again\n}")
+	})
+	t.Run("Missing loop clause", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f () () (while :Retry))`)
+	})
+}
+
+func TestQuasiquoteErrors(t *testing.T) {
+	root := t.TempDir()
+	compileError := func(t *testing.T, expr string) error {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", "(package p)\n(func f ((x int)) ()\n  (print "+expr+"))", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = compiler.Config{SlickRoot: root}.Compile(rd)
+		return err
+	}
+	for expr, expected := range map[string]string{
+		"(quasiquote)":                   "test.slick:3:10: quasiquote form must have exactly one argument: (quasiquote)",
+		"(quasiquote a b)":               "test.slick:3:10: quasiquote form must have exactly one argument: (quasiquote a b)",
+		"`,@x":                           "test.slick:3:11: unquote-splicing must be an element of a quasiquoted list",
+		"`(a (unquote x x))":             "test.slick:3:14: unquote form must have exactly one argument: (unquote x x)",
+		"`(a (unquote-splicing))":        "test.slick:3:14: unquote-splicing form must have exactly one argument: (unquote-splicing)",
+		"(+ 1 ,x)":                       "test.slick:3:15: unquote outside of quasiquote",
+		",@x":                            "test.slick:3:10: unquote-splicing outside of quasiquote",
+		"`(a `(b ,,@x))":                 "cannot open plugin",
+		"`(a `(b (unquote-splicing x)))": "cannot open plugin",
+		"`(a ,@1)":                       "test.slick:3:14: unquote-splicing of a non-list: (unquote-splicing 1)",
+		"`(a ,@\"s\" b)":                 "test.slick:3:14: unquote-splicing of a non-list: (unquote-splicing s)",
+		"`(a ,@'b)":                      "test.slick:3:14: unquote-splicing of a non-list: (unquote-splicing (quote b))",
+		"`(a ,@:b)":                      "test.slick:3:14: unquote-splicing of a non-list: (unquote-splicing :b)",
+	} {
+		if err := compileError(t, expr); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("unexpected error %v for %v", err, expr)
+		}
+	}
+}
+
+func TestIfExpression(t *testing.T) {
+	t.Run("Inferred type", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int)) ()
+  (:= s (if-expr (> x 2) "big" "small"))
+  (:= y (if-expr (> x 2) (convert x int64) (convert 0 int64)))
+  (:= g (if-expr (> x 2) (func ((a int)) ((_ int)) (return a)) (func ((a int)) ((_ int)) (return 0))))
+  (:= n (if-expr false 1 (if-expr true 2 3)))
+  (:= a (if-expr false (make (slice (array 2 int)) 0) (make (slice (array 2 int)) 1)))
+  (print s y g n a))`,
+			"s := func() string {\nif x > 2 {\nreturn \"big\"\n}\nreturn \"small\"\n}()",
+			"y := func() int64 {",
+			"g := func() func(a int) (_ int) {",
+			"n := func() int {",
+			"a := func() [][2]int {")
+	})
+	t.Run("Explicit type", func(t *testing.T) {
+		expectContains(t, `(package p)
+(func f ((x int)) ((_ error))
+  (return (if-expr (> x 2) nil nil :type error)))`,
+			"return func() error {\nif x > 2 {\nreturn nil\n}\nreturn nil\n}()")
+	})
+	t.Run("Unknown type", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (print (if-expr (> x 2) x x)))`)
+	})
+	t.Run("Different types", func(t *testing.T) {
+		for _, branches := range []string{"1 2.5", "1 x", "x 2.5", "nil (convert x int64)", "(convert x int64) (convert x int32)", "1 (if-expr true 2 x)"} {
+			expectError(t, `(package p)
+(func f ((x float64)) ()
+  (print (if-expr (> x 2) `+branches+`)))`)
+		}
+	})
+	t.Run("Missing branch", func(t *testing.T) {
+		expectError(t, `(package p)
+(func f ((x int)) ()
+  (print (if-expr (> x 2) 1)))`)
+	})
+}
+
+func TestPackageClause(t *testing.T) {
+	t.Run("External test package", func(t *testing.T) {
+		expectContains(t, `(package list "Tests for package list." :external-test)`,
+			"// Tests for package list.\npackage list_test")
+	})
+	t.Run("Test suffix", func(t *testing.T) {
+		expectContains(t, `(package list_test)`, "package list_test")
+	})
+	t.Run("Duplicate test suffix", func(t *testing.T) {
+		expectError(t, `(package list_test :external-test)`)
+	})
+	t.Run("Invalid option", func(t *testing.T) {
+		expectError(t, `(package list :internal-test)`)
+	})
+}
+
+func TestTopLevelForms(t *testing.T) {
+	t.Run("Only package clause", func(t *testing.T) {
+		expectContains(t, `(package p)`, "package p")
+	})
+	t.Run("Only imports", func(t *testing.T) {
+		expectContains(t, `(package p) (import "fmt")`, "package p", `import "fmt"`)
+	})
+	t.Run("Invalid forms", func(t *testing.T) {
+		expectError(t, `(package p) 42`)
+		expectError(t, `(package p) (import "fmt") x`)
+		expectError(t, `(package p) (var (x :type int)) x`)
+	})
+}
+
+func TestImports(t *testing.T) {
+	t.Run("Grouped and sorted", func(t *testing.T) {
+		// Blank lines between groups are significant, so compact cannot be used.
+		result := compile(t, `(package p) (import "strings" (x "example.com/x") (_ "embed") (f "fmt" "Formatting.") (quote (u "unsafe")))`)
+		expected := "import (\n\t_ \"embed\"\n\t// Formatting.\n\tf \"fmt\"\n\t\"strings\"\n\n\tx \"example.com/x\"\n)"
+		if !strings.Contains(result, expected) {
+			t.Errorf("%q not found in:\n%s", expected, result)
+		}
+	})
+	t.Run("Merged declarations", func(t *testing.T) {
+		expectContains(t, `(package p) (import "strings") (import "bytes")`,
+			"import (\n\t\"bytes\"\n\t\"strings\"\n)")
+	})
+	t.Run("Single import", func(t *testing.T) {
+		expectContains(t, `(package p) (import "fmt")`, "import \"fmt\"\n")
+	})
+}
+
+func TestTypeDecl(t *testing.T) {
+	t.Run("Grouped specs", func(t *testing.T) {
+		result := compile(t, `(package p) (type (T int) (U "U is a string." string) (V (struct (x :type T))))`)
+		expected := "type (\n\tT int\n\t// U is a string.\n\tU string\n\tV struct {\n\t\tx T\n\t}\n)"
+		if !strings.Contains(result, expected) {
+			t.Errorf("%q not found in:\n%s", expected, result)
+		}
+	})
+	t.Run("Grouped aliases", func(t *testing.T) {
+		expectContains(t, `(package p) (type-alias (T int) (U string))`, "type (\nT = int\nU = string\n)")
+	})
+}
+
+func TestRedeclarations(t *testing.T) {
+	compileError := func(t *testing.T, src string) error {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = compiler.Compile(rd)
+		return err
+	}
+	t.Run("Package", func(t *testing.T) {
+		pkg := new(compiler.Package)
+		compileFile := func(file, src string) error {
+			rd, err := reader.NewReader(nil, file, src, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = compiler.Config{Package: pkg}.Compile(rd)
+			return err
+		}
+		if err := compileFile("a.slick", "(package p)\n(var (x :type int))\n(func f () ())"); err != nil {
+			t.Fatal(err)
+		}
+		if err := compileFile("a.slick", "(package p)\n(var (x :type int))\n(func f () ())"); err != nil {
+			t.Errorf("unexpected error %v when compiling a file again", err)
+		}
+		if err := compileFile("b.slick", "(package p)\n(type (T int))\n(func ((t T)) f () ())"); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		err := compileFile("c.slick", "(package p)\n(func g () ())\n(const (x := 1))")
+		if err == nil || !strings.Contains(err.Error(), "c.slick:3:8: x redeclared in this package, previous declaration at a.slick:2:6") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := compileFile("c.slick", "(package p)\n(func g () ())"); err != nil {
+			t.Errorf("unexpected error %v after fixing c.slick", err)
+		}
+	})
+	t.Run("Both positions", func(t *testing.T) {
+		err := compileError(t, "(package p)\n(var (x :type int))\n(func x () ())")
+		if err == nil || !strings.Contains(err.Error(), "test.slick:3:1: x redeclared in this file, previous declaration at test.slick:2:6") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Allowed", func(t *testing.T) {
+		expectContains(t, `(package p)
+(type (T int) (U int))
+(var (_ :type int) (x :type T))
+(const (_ := 1))
+(func ((t T)) String () ((_ string)) (return ""))
+(func ((u U)) String () ((_ string)) (return ""))
+(init)
+(init)
+(func f () () (var (x :type int)) (type (T string)) (print x))`,
+			"func f()")
+	})
+	for _, src := range []string{
+		`(package p) (func f () ()) (func f () ())`,
+		`(package p) (var ((x y) :type int)) (const (y := 1))`,
+		`(package p) (type (T int)) (type-alias (T int))`,
+		`(package p) (const (a := iota) b) (var (b :type int))`,
+		`(package p) (func f () ()) (define-constant f 42)`,
+	} {
+		if err := compileError(t, src); err == nil || !strings.Contains(err.Error(), "redeclared") {
+			t.Errorf("unexpected error %v for %s", err, src)
+		}
+	}
+}
+
+func TestClauseConditions(t *testing.T) {
+	config := compiler.Config{BuildTags: []string{"slicktest"}}
+	for cond, active := range map[string]bool{
+		"slicktest":                true,
+		"unknowntag":               false,
+		"!slicktest":               false,
+		"!unknowntag":              true,
+		"slicktest && unknowntag":  false,
+		"slicktest && !unknowntag": true,
+		"unknowntag || slicktest":  true,
+		"unknowntag || !slicktest": false,
+		"(slicktest || unknowntag) && " + build.Default.GOOS: true,
+		build.Default.GOARCH + " && !" + build.Default.GOOS:  false,
+	} {
+		result := compileWith(t, config, fmt.Sprintf(`(package p) (import "strings" (x "example.com/x" :when %q))`, cond))
+		if found := strings.Contains(result, `x "example.com/x"`); found != active {
+			t.Errorf("import with condition %q is included: %v, expected %v:\n%s", cond, found, active, result)
+		}
+	}
+	t.Run("Inactive use clause", func(t *testing.T) {
+		expectContainsWith(t, config, `(package p) (use (m "example.com/m" :when "!slicktest")) (var (x :type int))`, "var x int")
+	})
+	t.Run("Alternatives", func(t *testing.T) {
+		expectContainsWith(t, config, `(package p)
+(import (sys "example.com/sys/other" :when "!slicktest")
+        (sys "example.com/sys/test" :when "slicktest"))
+(var (x :type sys:T))`,
+			`sys "example.com/sys/test"`, "var x sys.T")
+	})
+	t.Run("Invalid condition", func(t *testing.T) {
+		expectError(t, `(package p) (import (x "example.com/x" :when "slicktest &&"))`)
+		expectError(t, `(package p) (import (x "example.com/x" :when "slicktest || (unknowntag"))`)
+	})
+}
+
+func TestQuotedImports(t *testing.T) {
+	compileError := func(t *testing.T, src string) error {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = compiler.Compile(rd)
+		return err
+	}
+	t.Run("Position", func(t *testing.T) {
+		err := compileError(t, "(package p)\n(import (quote (u \"unsafe\")))\n(var (x :type u:Pointer))")
+		if err == nil || !strings.Contains(err.Error(), `test.slick:3:6: Pointer of quoted import "unsafe" used outside of quoted context, import quoted at test.slick:2:9`) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Also imported", func(t *testing.T) {
+		out := compile(t, `(package p)
+(import "unsafe" (quote (u "unsafe")))
+(var (x :type u:Pointer))`)
+		if !strings.Contains(compact(out), compact("var x unsafe.Pointer")) {
+			t.Errorf("unexpected output:\n%s", out)
+		}
+	})
+	for _, src := range []string{
+		`(package p) (import (quote (u "unsafe"))) (func f () () (print (u:Sizeof 1)))`,
+		`(package p) (import (quote (u "unsafe"))) (type (T (struct (p :type u:Pointer))))`,
+		`(package p) (import (quote (u "unsafe"))) (func f ((p u:Pointer)) ())`,
+	} {
+		if err := compileError(t, src); err == nil || !strings.Contains(err.Error(), "outside of quoted context") {
+			t.Errorf("unexpected error %v for %s", err, src)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	t.Run("Multiple values", func(t *testing.T) {
+		expectContains(t, `(package p)
+(import "strconv")
+(func f ((m (map string int)) (x (interface)) (ch (chan int))) ()
+  (:= (a b) (values 1 2))
+  (= (values a b) (values b a))
+  (:= (v ok) (at m "k"))
+  (= (values v ok) (assert x int))
+  (= (values v ok) (<- ch))
+  (:= (s err) (strconv:Atoi "1"))
+  (= (values v _) (splice 1 2)))`,
+			"a, b := 1, 2",
+			"a, b = b, a",
+			"v, ok := m[\"k\"]",
+			"v, ok = x.(int)",
+			"v, ok = <-ch",
+			"s, err := strconv.Atoi(\"1\")",
+			"v, _ = 1, 2")
+	})
+	for _, src := range []string{
+		`(package p) (func f () () (:= (a b) (values 1 2 3)))`,
+		`(package p) (func f () () (= (values a b) 1))`,
+		`(package p) (func f () () (:= (a b c) (at m "k")))`,
+		`(package p) (func f () () (= (values a b) (+ 1 2)))`,
+		`(package p) (func f () () (+= (values a b) (values 1 2)))`,
+		`(package p) (func f () () (= a (values)))`,
+	} {
+		expectError(t, src)
+	}
+}
+
+func TestAlignLines(t *testing.T) {
+	config := compiler.Config{AlignLines: true}
+	src := `(package p)
+
+;; Comments leave room for padding.
+(func f ((x int)) ((_ int))
+  ;; first
+  (:= y (+ x 1))
+
+  (if (> y 1)
+
+    (return y))
+  (return x))
+`
+	out := compileWith(t, config, src)
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Compile(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(result), "\n")
+	for line, fragment := range map[int]string{4: "func f(", 6: "y := (x + 1)", 8: "if (y > 1) {", 10: "return y"} {
+		if !strings.HasPrefix(lines[line-1], fragment) {
+			t.Errorf("line %v is %q instead of %q in:\n%s", line, lines[line-1], fragment, result)
+		}
+	}
+	if strings.ContainsRune(out, 0) {
+		t.Errorf("line marks in output:\n%s", out)
+	}
+	t.Run("NUL bytes", func(t *testing.T) {
+		expectContainsWith(t, config, `(package p)
+
+(func f () () "F ends with a NUL byte: \x00 "
+  (println 1))`,
+			"// F ends with a NUL byte: \\x00\nfunc f() {\n\tprintln(1)")
+	})
+}
+
+func TestConfig(t *testing.T) {
+	compileError := func(t *testing.T, config compiler.Config, src string) error {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = config.Compile(rd)
+		return err
+	}
+	t.Run("SlickPath", func(t *testing.T) {
+		dir := t.TempDir()
+		err := compileError(t, compiler.Config{SlickPath: dir}, `(package p) (use "example.com/m")`)
+		if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "plugins", "example.com/m", "slick", "plugin.so")) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("SlickRoot", func(t *testing.T) {
+		dir := t.TempDir()
+		err := compileError(t, compiler.Config{SlickRoot: dir}, `(package p) (var (x := '(a b)))`)
+		if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "plugins", "plugin.so")) {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Resolver", func(t *testing.T) {
+		resolver := reader.NewPackageResolver()
+		resolver.Aliases["github.com/pcostanza/slick/list"] = "slicklist"
+		config := compiler.Config{Resolver: resolver}
+		for _, file := range []string{"a.slick", "b.slick"} {
+			rd, err := reader.NewReader(nil, file, `(package p) (var (x := ()))`, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := config.Compile(rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fragment := range []string{`import slicklist "github.com/pcostanza/slick/list"`, "slicklist.Nil()"} {
+				if !strings.Contains(string(result), fragment) {
+					t.Errorf("%v: %q not found in:\n%s", file, fragment, result)
+				}
+			}
+		}
+	})
+	t.Run("No home directory", func(t *testing.T) {
+		t.Setenv("SLICKPATH", "")
+		t.Setenv("HOME", "")
+		if err := compileError(t, compiler.Config{}, `(package p) (var (x :type int))`); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		err := compileError(t, compiler.Config{}, `(package p) (use "example.com/m")`)
+		if err == nil || !strings.Contains(err.Error(), "SLICKPATH is not set") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Independent settings", func(t *testing.T) {
+		src := `(package p) (import (x "example.com/x" :when "slicktest"))
+
+(var (y :type x:T))`
+		tagged := compiler.Config{BuildTags: []string{"slicktest"}, AlignLines: true}
+		for i := 0; i < 2; i++ {
+			if result := compileWith(t, tagged, src); !strings.Contains(result, `x "example.com/x"`) {
+				t.Errorf("import missing with build tag:\n%s", result)
+			}
+			if err := compileError(t, compiler.Config{}, src); err == nil {
+				t.Error("no error without build tag")
+			}
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	var src strings.Builder
+	src.WriteString("(package p)\n(import \"fmt\")\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&src, "(func f%v ((x int)) ((_ int))\n  (fmt:Println \"f%v\" x)\n  (return (+ x %v)))\n", i, i, i)
+	}
+	generate := func(config compiler.Config) []byte {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", src.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := config.Compile(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	expected := generate(compiler.Config{})
+	if len(expected) < 2*64<<10 {
+		t.Fatalf("source too small for streaming: %v bytes", len(expected))
+	}
+	if result := generate(compiler.Config{Stream: true}); !bytes.Equal(result, expected) {
+		t.Errorf("streamed result differs:\n%s", result)
+	}
+	expected = generate(compiler.Config{AlignLines: true})
+	if result := generate(compiler.Config{Stream: true, AlignLines: true}); !bytes.Equal(result, expected) {
+		t.Errorf("streamed result with aligned lines differs:\n%s", result)
+	}
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("temporary files %v not removed", files)
+	}
+}
+
+func TestFuncDecl(t *testing.T) {
+	t.Run("Empty result list", func(t *testing.T) {
+		expectContains(t, `(package p) (func f ((x int)) () "F does nothing." (println x))`,
+			"// F does nothing.\nfunc f(x int) {\nprintln(x)\n}")
+	})
+	t.Run("Empty body", func(t *testing.T) {
+		expectContains(t, `(package p) (func f () ())`, "func f() {}")
+	})
+	t.Run("Without body", func(t *testing.T) {
+		expectContains(t, `(package p) (func f ((x int)) ((y int)))`, "func f(x int) (y int)\n")
+	})
+	t.Run("Documented without body", func(t *testing.T) {
+		for src, expected := range map[string]string{
+			`(package p) (func g ((x int)) ((y int)) "doc")`:                                     "// doc\nfunc g(x int) (y int)\n",
+			`(package p) (func flushICache (((begin end) uintptr)) () "implemented externally")`: "// implemented externally\nfunc flushICache(begin, end uintptr)\n",
+		} {
+			if result := compile(t, src); !strings.HasSuffix(result, expected) {
+				t.Errorf("%q not at the end of:\n%s", expected, result)
+			}
+		}
+	})
+	t.Run("Invalid variadic parameter", func(t *testing.T) {
+		expectError(t, `(package p) (func f ((x ... int) (y int)) () (println x))`)
+	})
+	t.Run("Invalid parameter type", func(t *testing.T) {
+		expectError(t, `(package p) (func f ((x int int)) ())`)
+	})
+}
+
+func TestRuneLiterals(t *testing.T) {
+	expectContains(t, `(package p) (var (a := #\a) (b := #\\n) (c := #\\x41) (d := #\\u00e9))`,
+		"a = 'a'", "b = '\\n'", "c = 'A'", "d = 'é'")
+}
+
+func TestMalformedForms(t *testing.T) {
+	for _, src := range []string{
+		`(package p) (func f () () (if true))`,
+		`(package p) (func f () () (if* x true (print)))`,
+		`(package p) (func f () () (for (1 2 3 4) (print)))`,
+		`(package p) (func f () () (for (x) (print)))`,
+		`(package p) (func f () () (range (:= 1 xs) (print)))`,
+		`(package p) (func f () () (range (:= x)))`,
+		`(package p) (func f () () (switch))`,
+		`(package p) (func f () () (switch* x))`,
+		`(package p) (func f () () (switch x (() 1)))`,
+		`(package p) (func f () () (type-switch 1 x))`,
+		`(package p) (func f () () (= x))`,
+		`(package p) (func f () () (:= 1 2))`,
+		`(package p) (func f () () (go))`,
+		`(package p) (func f () () (x . y))`,
+		`(package p) (func f () () (print (%)))`,
+		`(package p) (func f () () (print (make)))`,
+		`(package p) (func f () () (print (slot x)))`,
+		`(package p) (func f () () (print (make-struct T a)))`,
+		`(package p) (func f () () (print (make-map)))`,
+		`(package p) (func f () () (print (x . y)))`,
+		`(package p) (var (x :type (map int)))`,
+		`(package p) (var (x :type (func 1)))`,
+		`(package p) (type (T (ptr . int)))`,
+	} {
+		expectError(t, src)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// TestGolden compiles each .slick file in testdata and compares the
+// formatted result with the corresponding .golden file.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.slick"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := compile(t, string(src))
+			checkGolden(t, strings.TrimSuffix(file, ".slick")+".golden", result)
+		})
+	}
+}
+
+// checkGolden compares result with the contents of the golden file, or
+// updates the golden file with -update.
+func checkGolden(t *testing.T, golden, result string) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(golden, []byte(result), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != string(expected) {
+		t.Errorf("result differs from %v:\n%s", golden, result)
+	}
+}
+
+// TestGoldenQuoted compares the output for quoted lists, with and without
+// interning, with golden files. The names of the pooled variables are
+// generated, so they are renumbered in the order of their occurrence.
+func TestGoldenQuoted(t *testing.T) {
+	config := pluginConfig(t)
+	src, err := os.ReadFile(filepath.Join("testdata", "quoted", "pool.slick"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := regexp.MustCompile(`_quoted[0-9]+`)
+	for _, intern := range []bool{false, true} {
+		config.InternQuotedLists = intern
+		golden := filepath.Join("testdata", "quoted", "pool.golden")
+		if intern {
+			golden = filepath.Join("testdata", "quoted", "pool.interned.golden")
+		}
+		names := make(map[string]string)
+		result := quoted.ReplaceAllStringFunc(compileWith(t, config, string(src)), func(name string) string {
+			if _, ok := names[name]; !ok {
+				names[name] = fmt.Sprintf("_quoted%v", len(names)+1)
+			}
+			return names[name]
+		})
+		checkGolden(t, golden, result)
+	}
+}
+
+func TestQuasiquoteExpansion(t *testing.T) {
+	config := pluginConfig(t)
+	for _, test := range []struct {
+		name, expr, expected string
+	}{
+		{"Splice at head", "`(,@x b c)", `return list.Append(x, _quoted`},
+		{"Splice in the middle", "`(a ,@x c)", `return list.Cons(quoted("a"), list.Append(x, _quoted`},
+		{"Splice at tail", "`(a b ,@x)", `return list.Cons(quoted("a"), list.Cons(quoted("b"), x))`},
+		{"Splice only", "`(,@x)", `return x`},
+		{"Nested unquote", "`(a `(b ,(c ,x)))", `return list.Cons(quoted("a"), list.Cons(list.Cons(quoted("quasiquote"), list.Cons(list.Cons(quoted("b"), list.Cons(list.Cons(quoted("unquote"), list.Cons(list.Cons(quoted("c"), list.Cons(x, quoted("()"))), quoted("()"))), quoted("()"))), quoted("()"))), quoted("()")))`},
+		{"Nested splice", "`(a `(b ,@,@x))", `list.Cons(list.Cons(quoted("unquote-splicing"), x), quoted("()"))`},
+		{"Nested constant", "`(a `(b ,c))", `quoted("(a (quasiquote (b (unquote c))))")`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			expectContainsWith(t, config, `(package p)
+(import "github.com/pcostanza/slick/list")
+(func f ((x (* list:Pair))) ((_ (interface)))
+  (return `+test.expr+`))`, test.expected)
+		})
+	}
+}
+
+func TestQuasiquoteTemplates(t *testing.T) {
+	config := pluginConfig(t)
+	src := "(package p)\n" +
+		"(func f ((x int)) ((_ (interface))) (return `((a b c) ,x (a b c) (d ,x (a b c)))))\n" +
+		"(func g () ((_ (interface))) (return `(a b c)))"
+	pooled := func(config compiler.Config) int {
+		t.Helper()
+		rd, err := reader.NewReader(nil, "test.slick", src, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := config.Compile(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(result), " = quoted(")
+	}
+	if n := pooled(config); n != 4 {
+		t.Errorf("%v pooled variables, expected one per constant part", n)
+	}
+	config.InternQuotedLists = true
+	if n := pooled(config); n != 2 {
+		t.Errorf("%v pooled variables, expected one per distinct constant part", n)
+	}
+}
+
+func TestConstantData(t *testing.T) {
+	config := pluginConfig(t)
+	t.Run("Valid", func(t *testing.T) {
+		expectContainsWith(t, config, `(package p)
+(import "github.com/pcostanza/slick/list")
+(define-constant colors '(red green blue))
+(define-constant table (list:List `+"`"+`(primary ,@colors) (list:Reverse colors)))
+(func f () ()
+  (:=# greeting `+"`"+`(hello ,(list:Car colors)))
+  (print greeting))`,
+			`var colors = quoted("(red green blue)")`,
+			`var table = quoted("((primary red green blue) (blue green red))")`,
+			`greeting := _quoted`,
+			`= quoted("(hello red)")`)
+	})
+	t.Run("Redefinition", func(t *testing.T) {
+		_, err := compileResult(t, config, `(package p) (define-constant a 1) (define-constant a 2)`)
+		if err == nil || !strings.Contains(err.Error(), "a redeclared") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Not constant", func(t *testing.T) {
+		for src, expected := range map[string]string{
+			`(var (v := 1)) (define-constant a v)`:                                        "test.slick:1:28: v is not a constant",
+			`(func g () ((_ int)) (return 1)) (define-constant a (g))`:                    "test.slick:1:46: (g) cannot be evaluated at compile time",
+			`(import "github.com/pcostanza/slick/list") (define-constant a (list:Car 1))`: "test.slick:1:56: invalid constant expression (github.com/pcostanza/slick/list:Car 1): 1 is not a pair",
+			`(func f () () (:=# a (+ 1 2)) (print a))`:                                    "test.slick:1:27: (+ 1 2) cannot be evaluated at compile time",
+		} {
+			_, err := compileResult(t, config, "(package p) "+src)
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Errorf("unexpected error %v for %v", err, src)
+			}
+		}
+	})
+}
+
+func TestParseShape(t *testing.T) {
+	for _, test := range []struct {
+		shape    string
+		min, max int
+		err      string
+	}{
+		{shape: "(M)", min: 0, max: 0},
+		{shape: "(M a b)", min: 2, max: 2},
+		{shape: " (M a (b c)) ", min: 2, max: 2},
+		{shape: "(M a b ...)", min: 1, max: -1},
+		{shape: "(M a ... b)", min: 1, max: -1},
+		{shape: "(M ((name value) ...) body ...)", min: 1, max: -1},
+		{shape: "(M body ...)", min: 0, max: -1},
+		{shape: "(M ... a)", err: "misplaced ... in shape of M"},
+		{shape: "(M a ... ...)", err: "misplaced ... in shape of M"},
+		{shape: "(N a)", err: "shape of M does not start with its name"},
+		{shape: `("M" a)`, err: "shape of M does not start with its name"},
+		{shape: "M", err: "shape of M is not a single list"},
+		{shape: "()", err: "shape of M is not a single list"},
+		{shape: "(M a) (M b)", err: "shape of M is not a single list"},
+		{shape: "(M a", err: "shape"},
+	} {
+		min, max, err := compiler.MacroInfo{Name: "M", Shape: test.shape}.Arity()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("unexpected error %v for %q", err, test.shape)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error %v for %q", err, test.shape)
+		} else if min != test.min || max != test.max {
+			t.Errorf("arity of %q is %v..%v, expected %v..%v", test.shape, min, max, test.min, test.max)
+		}
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+	manifest := compiler.Manifest{
+		{Name: "Let", Shape: "(Let ((name value) ...) body ...)", Doc: "Binds names."},
+		{Name: "Swap", Shape: "(Swap a b)"},
+		{Name: "Debug"},
+	}
+	if err := manifest.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if min, max, err := manifest[2].Arity(); err != nil || min != 0 || max != -1 {
+		t.Errorf("unexpected arity %v..%v, %v without shape", min, max, err)
+	}
+	for _, test := range []struct {
+		manifest compiler.Manifest
+		err      string
+	}{
+		{compiler.Manifest{{Name: ""}}, "macro without name"},
+		{compiler.Manifest{{Name: "Let"}, {Name: "Swap"}, {Name: "Let", Shape: "(Let body ...)"}}, "duplicate macro Let"},
+		{compiler.Manifest{{Name: "Let", Shape: "(Swap a b)"}}, "shape of Let does not start with its name"},
+		{compiler.Manifest{{Name: "Swap", Shape: "(Swap ... a)"}}, "misplaced ... in shape of Swap"},
+	} {
+		if err := test.manifest.Check(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("unexpected error %v for %v", err, test.manifest)
+		}
+	}
+}
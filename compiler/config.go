@@ -0,0 +1,179 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+// A Config determines where the compiler finds plugins and how it runs
+// macros, how it names packages, how it generates and writes its output,
+// and which files belong to the same package. Empty directories default
+// to the corresponding environment variables, and if those are not set
+// either, to the directory slick in the home directory of the user. The
+// zero Config is the default configuration of the slick command.
+type Config struct {
+	// SlickPath is the directory of installed plugins: The plugin with
+	// import path p is the file SlickPath/plugins/p/slick/plugin.so. It
+	// defaults to the SLICKPATH environment variable.
+	SlickPath string
+	// SlickRoot is the root directory of the Slick installation, with the
+	// core Slick plugin in SlickRoot/plugins/plugin.so. It defaults to the
+	// SLICKROOT environment variable.
+	SlickRoot string
+	// Resolver, if not nil, provides the aliases for packages that are
+	// imported automatically, as for macro expansions. The package
+	// resolver of the reader is replaced by a resolver derived from it
+	// before the source file is read, see PackageResolver.Derive, so
+	// Resolver is not modified, and can be used for several files.
+	Resolver *reader.PackageResolver
+	// Stream determines whether compiled declarations are written to a
+	// temporary file while the source file is compiled, instead of being
+	// kept in memory until the end, which bounds the memory needed for
+	// very large, typically machine-generated source files.
+	Stream bool
+	// Package, if not nil, collects the top-level definitions of the
+	// files of a package that are compiled with it, so that redefinitions
+	// across these files are reported. Definitions of a file that has
+	// been compiled with Package before are replaced.
+	Package *Package
+	// Cache, if not nil, memoizes macro expansions across the files and
+	// repeated compilations that use it. Otherwise, macro expansions
+	// are only memoized within a file.
+	Cache *MacroCache
+	// Macros limits the execution of macro functions.
+	Macros MacroPolicy
+	// UsePluginHosts determines whether plugins are loaded into separate
+	// plugin host processes instead of into the compiler process. This
+	// enables reloading plugins that have been rebuilt, as needed for
+	// watch mode.
+	UsePluginHosts bool
+	// PluginHostExecutable is the executable that is started for plugin
+	// host processes, which defaults to the compiler executable itself. On
+	// platforms without plugin support, where plugins cannot be loaded
+	// into the compiler process, a compiler executable built for a
+	// platform with plugin support can serve as plugin host instead.
+	PluginHostExecutable string
+	// InternQuotedLists determines whether structurally identical quoted
+	// lists within a file, including the constant parts of quasiquote
+	// templates, share a single package-level variable. Note that this
+	// makes the sharing observable to programs that modify quoted lists,
+	// or the lists constructed from quasiquote templates.
+	InternQuotedLists bool
+	// BuildTags are additional build tags that are considered satisfied
+	// by the conditions of import and use clauses, besides the tags for
+	// the target platform as determined by the GOOS and GOARCH
+	// environment variables, and the other tags that the go command
+	// satisfies by default.
+	BuildTags []string
+	// AlignLines determines whether the compiler pads the generated code
+	// with blank lines, so that statements and top-level declarations
+	// start on the same lines as their forms in the source file where
+	// possible. This keeps the line numbers in stack traces and compiler
+	// errors close to the source file, without line directives.
+	// Formatting the generated code with gofmt removes the padding.
+	AlignLines bool
+}
+
+// configDir returns dir, or the default for dir if it is empty.
+func configDir(dir, variable string) (string, error) {
+	if dir != "" {
+		return dir, nil
+	}
+	if dir = os.Getenv(variable); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("%v is not set, and there is no default: %v", variable, err)
+	}
+	return filepath.Join(home, "slick"), nil
+}
+
+// pluginFile returns the plugin file for the import path of a plugin,
+// or of a plugin macro symbol.
+func (config Config) pluginFile(path string) (string, error) {
+	slickPath, err := configDir(config.SlickPath, "SLICKPATH")
+	if err != nil {
+		return "", err
+	}
+	if path[0] == '#' {
+		path = path[1:]
+	}
+	return filepath.Join(slickPath, "plugins", path, "slick/plugin.so"), nil
+}
+
+// libPlugin returns the file of the core Slick plugin.
+func (config Config) libPlugin() (string, error) {
+	slickRoot, err := configDir(config.SlickRoot, "SLICKROOT")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(slickRoot, "plugins", "plugin.so"), nil
+}
+
+// pluginFile returns the plugin file for path, reporting errors at form.
+func (cmp *compiler) pluginFile(form *list.Pair, path string) (string, bool) {
+	file, err := cmp.config.pluginFile(path)
+	if err != nil {
+		cmp.error(form, fmt.Sprintf("cannot open plugin: %v", err))
+		return "", false
+	}
+	return file, true
+}
+
+// libPlugin returns the file of the core Slick plugin, reporting errors
+// at form.
+func (cmp *compiler) libPlugin(form *list.Pair) (string, bool) {
+	file, err := cmp.config.libPlugin()
+	if err != nil {
+		cmp.error(form, fmt.Sprintf("cannot open plugin: %v", err))
+		return "", false
+	}
+	return file, true
+}
+
+// Compile compiles the source file read by rd with the given
+// configuration, and returns the resulting Go code.
+func (config Config) Compile(rd *reader.Reader) (result []byte, err error) {
+	var out output
+	if err := config.CompileTo(rd, &out); err != nil {
+		return nil, err
+	}
+	return out.code, nil
+}
+
+// CompileTo compiles the source file read by rd with the given
+// configuration, and writes the resulting Go code to w. Nothing is
+// written if the source file contains errors.
+func (config Config) CompileTo(rd *reader.Reader, w io.Writer) (err error) {
+	cmp := compiler{config: config, cache: config.Cache}
+	if cmp.cache == nil {
+		cmp.cache = new(MacroCache)
+	}
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if _, ok := e.(bailout); !ok {
+			panic(e)
+		}
+		err = cmp.reader.Errors.Err()
+	}()
+	if config.Resolver != nil {
+		rd.PackageResolver = config.Resolver.Derive()
+	}
+	cmp.init(rd)
+	if config.Package != nil {
+		config.Package.forget(rd.File().Name())
+	}
+	if err := cmp.compileFile(w); err != nil {
+		return err
+	}
+	return cmp.reader.Errors.Err()
+}
@@ -0,0 +1,203 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/pcostanza/slick/ast"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Constant data declarations evaluate simple, pure list expressions at
+compile time, and emit the resulting data structure as a literal, so
+that large static tables do not have to be constructed by the generated
+program. The literal is compiled as a quoted datum.
+*/
+
+var (
+	_define_constant   = lib.Intern("", "define-constant")
+	_colon_equal_const = lib.Intern("_keyword", "=#")
+)
+
+const listPath = "github.com/pcostanza/slick/list"
+
+type constantFunction = func(args []interface{}) (interface{}, error)
+
+func listArgs(args []interface{}) ([]*list.Pair, error) {
+	lists := make([]*list.Pair, len(args))
+	for i, arg := range args {
+		l, ok := arg.(*list.Pair)
+		if !ok || !list.IsProper(l) {
+			return nil, fmt.Errorf("%v is not a list", arg)
+		}
+		lists[i] = l
+	}
+	return lists, nil
+}
+
+func pairArg(args []interface{}) (*list.Pair, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected one argument")
+	}
+	pair, ok := args[0].(*list.Pair)
+	if !ok || pair == nil {
+		return nil, fmt.Errorf("%v is not a pair", args[0])
+	}
+	return pair, nil
+}
+
+// constantFunctions are the functions that can be invoked in constant
+// expressions.
+var constantFunctions = map[*lib.Symbol]constantFunction{
+	lib.Intern(listPath, "List"): func(args []interface{}) (interface{}, error) {
+		return list.List(args...), nil
+	},
+	lib.Intern(listPath, "Cons"): func(args []interface{}) (interface{}, error) {
+		if len(args) < 2 {
+			return nil, errors.New("expected at least two arguments")
+		}
+		return list.Cons(args[0], args[1], args[2:]...), nil
+	},
+	lib.Intern(listPath, "Append"): func(args []interface{}) (interface{}, error) {
+		lists, err := listArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return list.Append(lists...), nil
+	},
+	lib.Intern(listPath, "Reverse"): func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expected one argument")
+		}
+		lists, err := listArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return lists[0].Reverse(), nil
+	},
+	lib.Intern(listPath, "Car"): func(args []interface{}) (interface{}, error) {
+		pair, err := pairArg(args)
+		if err != nil {
+			return nil, err
+		}
+		return pair.Car, nil
+	},
+	lib.Intern(listPath, "Cdr"): func(args []interface{}) (interface{}, error) {
+		pair, err := pairArg(args)
+		if err != nil {
+			return nil, err
+		}
+		return pair.Cdr, nil
+	},
+}
+
+// evalConstant evaluates expr at compile time, reporting errors at form.
+func (cmp *compiler) evalConstant(form *list.Pair, expr interface{}) (interface{}, bool) {
+	expr, ok := cmp.expandMacros(form, expr)
+	if !ok {
+		return nil, false
+	}
+	switch e := expr.(type) {
+	case *big.Int, float64, complex128, rune, int, string:
+		return e, true
+	case *lib.Symbol:
+		if value, ok := cmp.constants[e]; ok {
+			return value, true
+		}
+		cmp.error(form, fmt.Sprintf("%v is not a constant", e))
+		return nil, false
+	case *list.Pair:
+		if e == nil {
+			return e, true
+		}
+		switch e.Car {
+		case _quote:
+			if !cmp.checkQuasiquote(e) {
+				return nil, false
+			}
+			return list.Cadr(e), true
+		case _quasiquote:
+			return cmp.evalConstant(form, cmp.expandQuasiquote(e))
+		}
+		sym, ok := e.Car.(*lib.Symbol)
+		if !ok || !list.IsProper(e) {
+			break
+		}
+		if path, ok := cmp.reader.PackageToPath[sym.Package]; ok {
+			sym = lib.Intern(path, sym.Identifier)
+		}
+		fn, ok := constantFunctions[sym]
+		if !ok {
+			break
+		}
+		var args []interface{}
+		for _, arg := range e.Cdr.(*list.Pair).ToSlice() {
+			value, ok := cmp.evalConstant(form, arg)
+			if !ok {
+				return nil, false
+			}
+			args = append(args, value)
+		}
+		value, err := fn(args)
+		if err != nil {
+			cmp.error(form, fmt.Sprintf("invalid constant expression %v: %v", e, err))
+			return nil, false
+		}
+		return value, true
+	}
+	cmp.error(form, fmt.Sprintf("%v cannot be evaluated at compile time", expr))
+	return nil, false
+}
+
+// constantDecl returns the name and the value of a constant data
+// declaration or statement.
+func (cmp *compiler) constantDecl(form *list.Pair) (*lib.Symbol, interface{}, bool) {
+	decl := form.ToSlice()
+	if len(decl) != 3 {
+		cmp.error(form, fmt.Sprintf("invalid %v form", form.Car))
+		return nil, nil, false
+	}
+	name, ok := decl[1].(*lib.Symbol)
+	if !ok || !ast.ValidSimpleIdentifier(name) {
+		cmp.error(form, fmt.Sprintf("invalid identifier %v", decl[1]))
+		return nil, nil, false
+	}
+	value, ok := cmp.evalConstant(form, decl[2])
+	return name, value, ok
+}
+
+func (cmp *compiler) compileConstantDecl(result []byte, form *list.Pair) []byte {
+	name, value, ok := cmp.constantDecl(form)
+	if !ok {
+		return result
+	}
+	cmp.define(form, name)
+	if name.Identifier != "_" {
+		if cmp.constants == nil {
+			cmp.constants = make(map[*lib.Symbol]interface{})
+		}
+		cmp.constants[name] = value
+	}
+	result = append(result, "var "...)
+	result = append(result, name.Identifier...)
+	result = append(result, " = "...)
+	active := cmp.pool.active
+	cmp.pool.active = true
+	result = cmp.compileExpression(result, form, list.List(_quote, value))
+	cmp.pool.active = active
+	return append(result, '\n', '\n')
+}
+
+func (cmp *compiler) compileConstantStatement(result []byte, form *list.Pair) []byte {
+	name, value, ok := cmp.constantDecl(form)
+	if !ok {
+		return result
+	}
+	result = append(result, name.Identifier...)
+	result = append(result, " := "...)
+	result = cmp.compileExpression(result, form, list.List(_quote, value))
+	return append(result, '\n')
+}
@@ -0,0 +1,59 @@
+package compiler
+
+import (
+	"fmt"
+	"go/build"
+	"go/build/constraint"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+var keyWhen = lib.Intern("_keyword", "when")
+
+var unixOS = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true, "illumos": true,
+	"ios": true, "linux": true, "netbsd": true, "openbsd": true, "solaris": true,
+}
+
+// matchBuildTag reports whether tag is satisfied, see Config.BuildTags.
+func (config Config) matchBuildTag(tag string) bool {
+	ctx := &build.Default
+	switch tag {
+	case ctx.GOOS, ctx.GOARCH, ctx.Compiler:
+		return true
+	case "unix":
+		return unixOS[ctx.GOOS]
+	case "cgo":
+		return ctx.CgoEnabled
+	case "linux":
+		return ctx.GOOS == "android"
+	case "solaris":
+		return ctx.GOOS == "illumos"
+	case "darwin":
+		return ctx.GOOS == "ios"
+	}
+	for _, tags := range [][]string{ctx.BuildTags, ctx.ReleaseTags, config.BuildTags} {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clauseActive reports whether the :when condition of an import or use
+// clause is satisfied. Conditions use the syntax of Go build constraints,
+// like "linux && amd64". An empty condition is always satisfied.
+func (cmp *compiler) clauseActive(clause *list.Pair, cond string) bool {
+	if cond == "" {
+		return true
+	}
+	expr, err := constraint.Parse("//go:build " + cond)
+	if err != nil {
+		cmp.error(clause, fmt.Sprintf("invalid clause condition %q: %v", cond, err))
+		return false
+	}
+	return expr.Eval(cmp.config.matchBuildTag)
+}
@@ -0,0 +1,185 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+
+	"github.com/pcostanza/slick/ast"
+	"github.com/pcostanza/slick/list"
+)
+
+type (
+	// Environment is the compile-time environment that is passed to
+	// macro functions along with the macro invocation form.
+	Environment struct {
+		cmp  *compiler
+		form *list.Pair
+		host *hostConn
+		exp  *expansion
+	}
+
+	emittedDecl struct {
+		form, origin *list.Pair
+	}
+)
+
+func (cmp *compiler) environment(form *list.Pair) Environment {
+	return Environment{cmp: cmp, form: form}
+}
+
+// RequireImport ensures that the package with the given import path is
+// imported by the file that is currently being compiled, and returns the
+// package name under which it is accessible. If alias is empty, an existing
+// import of the path is reused, or else a fresh package name is chosen. If
+// alias is "_", the package is imported solely for its side effects.
+//
+// Note that qualified identifiers whose package is a full import path,
+// such as the ones constructed by lib.Intern, are imported automatically.
+// RequireImport is only needed for imports with specific package names, or
+// for imports that are needed solely for their side effects.
+func (env Environment) RequireImport(path, alias string) (string, error) {
+	if env.host != nil {
+		return env.host.requireImport(path, alias)
+	}
+	if !env.enter() {
+		return "", errAbandoned
+	}
+	defer env.leave()
+	cmp := env.cmp
+	// Every call counts as an effect, even if the package is already
+	// imported, so that the expansion is not cached and replayed in a
+	// file where it is not imported yet.
+	cmp.effects++
+	if !ast.ValidImportPath(path) {
+		return "", fmt.Errorf("invalid import path: %v", path)
+	}
+	switch alias {
+	case "":
+		name, enclosed := cmp.reader.EnclosePackage(path)
+		if enclosed {
+			cmp.addImport(name, path)
+		}
+		return name, nil
+	case "_":
+		cmp.addImport(alias, path)
+		return alias, nil
+	}
+	if !ast.ValidGoIdentifier(alias) {
+		return "", fmt.Errorf("invalid import identifier %v", alias)
+	}
+	if existing, ok := cmp.reader.PackageToPath[alias]; ok {
+		if existing == path {
+			return alias, nil
+		}
+		return "", fmt.Errorf("ambiguous import %v", alias)
+	}
+	cmp.reader.PackageToPath[alias] = path
+	if _, ok := cmp.reader.PathToPackage[path]; !ok {
+		cmp.reader.PathToPackage[path] = alias
+	}
+	cmp.addImport(alias, path)
+	return alias, nil
+}
+
+// EmitTopLevel adds a top-level declaration to the file that is currently
+// being compiled, for example an auxiliary function needed by the expansion
+// of a macro. The declaration is compiled after the top-level declaration
+// that contains the macro invocation.
+func (env Environment) EmitTopLevel(form *list.Pair) error {
+	if env.host != nil {
+		if form == nil {
+			return errors.New("emitted top-level declaration is not a list")
+		}
+		return env.host.emitTopLevel(form)
+	}
+	if !env.enter() {
+		return errAbandoned
+	}
+	defer env.leave()
+	env.cmp.effects++
+	if form == nil {
+		return errors.New("emitted top-level declaration is not a list")
+	}
+	env.cmp.emitted = append(env.cmp.emitted, emittedDecl{form: form, origin: env.form})
+	return nil
+}
+
+func (cmp *compiler) compileEmittedDecls(result []byte) []byte {
+	for len(cmp.emitted) > 0 {
+		decl := cmp.emitted[0]
+		cmp.emitted = cmp.emitted[1:]
+		origin := cmp.origin
+		cmp.origin = decl.origin
+		result = cmp.compileDecl(result, decl.form)
+		cmp.origin = origin
+	}
+	return result
+}
+
+// Errorf reports an error during macro expansion. The error is positioned
+// at form if it is a list that stems from the source file, for example a
+// subform of the macro invocation form, or else at the macro invocation.
+// After a macro reported an error, the form it returns is ignored.
+func (env Environment) Errorf(form interface{}, format string, args ...interface{}) {
+	if env.host != nil {
+		env.host.report(msgError, form, fmt.Sprintf(format, args...))
+		return
+	}
+	if !env.enter() {
+		return
+	}
+	defer env.leave()
+	env.report(&env.cmp.reader.Errors, form, fmt.Sprintf(format, args...))
+	env.cmp.reports++
+}
+
+// Warnf reports a warning during macro expansion. The warning is positioned
+// in the same way as errors reported by Errorf. Warnings do not affect the
+// outcome of the macro expansion.
+func (env Environment) Warnf(form interface{}, format string, args ...interface{}) {
+	if env.host != nil {
+		env.host.report(msgWarning, form, fmt.Sprintf(format, args...))
+		return
+	}
+	if !env.enter() {
+		return
+	}
+	defer env.leave()
+	env.report(&env.cmp.reader.Warnings, form, fmt.Sprintf(format, args...))
+}
+
+func (env Environment) report(diagnostics *scanner.ErrorList, form interface{}, msg string) {
+	cmp := env.cmp
+	cmp.effects++
+	pos := cmp.position(env.form)
+	if pair, ok := form.(*list.Pair); ok {
+		if fpos, _ := cmp.reader.FormPos(pair); fpos.IsValid() {
+			pos = cmp.reader.File().Position(fpos)
+		}
+	}
+	diagnostics.Add(pos, msg)
+	if cmp.reader.Errors.Len() > 10 {
+		panic(bailout{})
+	}
+}
+
+var errReported = errors.New("errors reported during macro expansion")
+
+func (cmp *compiler) expand(file, name string, fn macro, form *list.Pair) (interface{}, error) {
+	if err := cmp.checkExpansions(name, form); err != nil {
+		return nil, err
+	}
+	reports := cmp.reports
+	newForm, err := cmp.cache.expand(cmp.environment(form), file, name, fn, form)
+	if err == nil && cmp.reports != reports {
+		return nil, errReported
+	}
+	return newForm, err
+}
+
+func (cmp *compiler) macroError(form *list.Pair, msg string, err error) {
+	if err != errReported {
+		cmp.error(form, fmt.Sprintf("%v: %v", msg, err))
+	}
+}
@@ -0,0 +1,62 @@
+package compiler_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pcostanza/slick/compiler"
+	"github.com/pcostanza/slick/reader"
+)
+
+var fuzzSeeds = []string{
+	`(package p)`,
+	`(package)`,
+	`(package 42)`,
+	`package`,
+	`(package p) (import 42 (f) (quote x) (quote (f "fmt" :when 1)))`,
+	`(package p) (use 42 (m) (m "example.com/missing"))`,
+	`(package p) (func)`,
+	`(package p) (func (x) f)`,
+	`(package p) (func f x)`,
+	`(package p) (func f ((x)) (y) z)`,
+	`(package p) (var) (const x) (type (t)) (type-alias 42)`,
+	`(package p) (func f () () (if) (for) (switch) (select) (range) (return . x))`,
+	`(package p) (func f () () (:= x) (= . y) (go) (defer 42) (x . y) (switch* 1 x) (type-switch 1 x))`,
+	`(package p) (func f () () (for (1 2 3)) (range (:= 1 x)) (if* 1 2 3) (%) (make) (slot x))`,
+	`(package p) (func f () () (quote) (quasiquote (unquote)) (splice . x) (values))`,
+	`(package p) (var x :type int :=) (var (x 1) :type int) (var . x) (var ()) (const (x . y))`,
+	`(package p) (type) (type ()) (type (t "doc")) (type (42 int)) (declare) (init . x) (x . y)`,
+	`(package p) (type (T (1 int)) (U ("struct")) (V ((chan) int)) (W (struct (1 int))) (X (interface (1 ()))))`,
+	`(package p) (func f () () (switch 1 ((1) 2) (1 :when) ("x" :when 1 2)) (type-switch x y (1 2) ("int")))`,
+	`(package p) (func f () () (1 2) ("s") ((f) x) (print ((x) 1) (1 2)) (select ((1) 2)) (range (1 x)))`,
+	`(package p) (var (1 := 2)) (const ("x" := 1)) (42) ("s" 1) ((f) 1) (define-constant 1 2)`,
+}
+
+// FuzzCompile checks that the compiler reports errors instead of
+// panicking on arbitrary input. Macros from plugins are not expanded,
+// since the plugins are not built for the fuzzing binary. The reader has
+// no syntax for dotted lists, so they are covered by TestDottedForms.
+func FuzzCompile(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.slick"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(src))
+	}
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		rd, err := reader.NewReader(nil, "fuzz.slick", src, nil)
+		if err != nil {
+			return
+		}
+		compiler.Compile(rd)
+	})
+}
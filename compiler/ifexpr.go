@@ -0,0 +1,137 @@
+package compiler
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Go has no conditional expression, so the compiler lowers if-expr forms
+to immediately invoked function literals that return one of the two
+values. The result type of the function literal is either given with
+:type, or inferred from the branches as far as this is possible without
+type checking. Inferred types must be the same for both branches, since
+basic literals only have their default types, which other branches do not
+necessarily have.
+*/
+
+var (
+	_if_expr = lib.Intern("", "if-expr")
+	_true    = lib.Intern("", "true")
+	_false   = lib.Intern("", "false")
+
+	_bool       = lib.Intern("", "bool")
+	_int        = lib.Intern("", "int")
+	_float64    = lib.Intern("", "float64")
+	_complex128 = lib.Intern("", "complex128")
+	_rune       = lib.Intern("", "rune")
+	_string     = lib.Intern("", "string")
+)
+
+// inferType returns the type of expr, or nil if it cannot be determined
+// without type checking.
+func inferType(expr interface{}) interface{} {
+	switch e := expr.(type) {
+	case *big.Int:
+		return _int
+	case float64:
+		return _float64
+	case complex128:
+		return _complex128
+	case rune:
+		return _rune
+	case string:
+		return _string
+	case *lib.Symbol:
+		if e == _true || e == _false {
+			return _bool
+		}
+	case *list.Pair:
+		if e == nil || !list.IsProper(e) || e.Cdr == list.Nil() {
+			return nil
+		}
+		switch e.Car {
+		case _make, _make_struct, _make_array, _make_slice, _make_map:
+			return list.Cadr(e)
+		case _convert:
+			if e.Length() == 3 {
+				return list.Caddr(e)
+			}
+		case _func:
+			if e.Length() == 2 {
+				return list.List(_func, list.Cadr(e))
+			}
+			return list.List(_func, list.Cadr(e), list.Caddr(e))
+		case _if_expr:
+			args := e.ToSlice()
+			if len(args) != 4 && len(args) != 6 {
+				return nil
+			}
+			if typ, ok := getf(ifExprOptions(e), keyType); ok {
+				return typ
+			}
+			return inferBranchesType(args[2], args[3])
+		}
+	}
+	return nil
+}
+
+// inferBranchesType returns the type of the branches a and b of an
+// if-expr form, or nil if they do not have the same inferred type.
+func inferBranchesType(a, b interface{}) interface{} {
+	typ := inferType(a)
+	if typ == nil || !sameType(typ, inferType(b)) {
+		return nil
+	}
+	return typ
+}
+
+// sameType reports whether the type forms x and y are structurally equal.
+func sameType(x, y interface{}) bool {
+	switch x := x.(type) {
+	case *list.Pair:
+		return list.EqualWith(x, y, sameType)
+	case *big.Int:
+		y, ok := y.(*big.Int)
+		return ok && x.Cmp(y) == 0
+	}
+	return x == y
+}
+
+// ifExprOptions returns the keyword options that follow the branches of
+// an if-expr form.
+func ifExprOptions(form *list.Pair) *list.Pair {
+	if options, ok := form.Drop(4).(*list.Pair); ok {
+		return options
+	}
+	return list.Nil()
+}
+
+func (cmp *compiler) compileIfExpression(result []byte, form *list.Pair) []byte {
+	expr := form.ToSlice()
+	if len(expr) != 4 && len(expr) != 6 {
+		cmp.error(form, fmt.Sprintf("invalid if-expr form %v", form))
+		return result
+	}
+	options := ifExprOptions(form)
+	cmp.checkf(form, options, keyType)
+	typ, ok := getf(options, keyType)
+	if !ok {
+		if typ = inferBranchesType(expr[2], expr[3]); typ == nil {
+			cmp.error(form, fmt.Sprintf("cannot infer the type of %v, use :type to specify it", form))
+			return result
+		}
+	}
+	result = append(result, "func() "...)
+	result = cmp.compileType(result, form, typ)
+	result = append(result, " {\nif "...)
+	result = cmp.compileExpression(result, form, expr[1])
+	result = append(result, " {\nreturn "...)
+	result = cmp.compileExpression(result, form, expr[2])
+	result = append(result, "\n}\nreturn "...)
+	result = cmp.compileExpression(result, form, expr[3])
+	return append(result, "\n}()"...)
+}
@@ -0,0 +1,111 @@
+package compiler
+
+import (
+	"sort"
+	"strings"
+)
+
+// An importSpec is an import of the file that is currently being compiled.
+// Imports are collected while the file is compiled, both from the import
+// declarations and from enclosed symbols and required imports, and are
+// only written to the header at the end, as a single import declaration.
+type importSpec struct {
+	name, path, doc string
+	enclosed        bool // added by the compiler, not by the user
+}
+
+// Import groups, in the order in which they are written, like goimports
+// does: standard library packages, other packages, and finally packages
+// that are only imported because of macro expansions.
+const (
+	stdlibImports = iota
+	externalImports
+	enclosedImports
+)
+
+func (spec importSpec) group() int {
+	switch {
+	case spec.enclosed:
+		return enclosedImports
+	case isStdlibPath(spec.path):
+		return stdlibImports
+	default:
+		return externalImports
+	}
+}
+
+// isStdlibPath reports whether path is the import path of a standard
+// library package, using the same heuristic as goimports: The first
+// element of the path does not contain a dot.
+func isStdlibPath(path string) bool {
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[:i]
+	}
+	return !strings.Contains(path, ".")
+}
+
+func (cmp *compiler) addImport(name, path string) {
+	cmp.imports = append(cmp.imports, importSpec{name: name, path: path, enclosed: true})
+}
+
+// sortedImports returns the collected imports in the order in which they
+// are written, with exact duplicates removed.
+func (cmp *compiler) sortedImports() []importSpec {
+	specs := make([]importSpec, 0, len(cmp.imports))
+	type key struct{ name, path string }
+	seen := make(map[key]bool, len(cmp.imports))
+	for _, spec := range cmp.imports {
+		k := key{spec.name, spec.path}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		specs = append(specs, spec)
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		si, sj := specs[i], specs[j]
+		if gi, gj := si.group(), sj.group(); gi != gj {
+			return gi < gj
+		}
+		if si.path != sj.path {
+			return si.path < sj.path
+		}
+		return si.name < sj.name
+	})
+	return specs
+}
+
+func formatImportSpec(result []byte, spec importSpec) []byte {
+	if spec.name != "" {
+		result = append(result, spec.name...)
+		result = append(result, ' ')
+	}
+	result = append(result, '"')
+	result = append(result, spec.path...)
+	return append(result, '"', '\n')
+}
+
+// compileImports writes the collected imports as a single import
+// declaration, with the groups separated by blank lines.
+func (cmp *compiler) compileImports(result []byte) []byte {
+	specs := cmp.sortedImports()
+	switch {
+	case len(specs) == 0:
+		return result
+	case len(specs) == 1 && specs[0].doc == "":
+		result = append(result, "import "...)
+		result = formatImportSpec(result, specs[0])
+		return append(result, '\n')
+	}
+	result = append(result, "import (\n"...)
+	for i, spec := range specs {
+		if i > 0 && spec.group() != specs[i-1].group() {
+			result = append(result, '\n')
+		}
+		if spec.doc != "" {
+			result = formatComment(result, spec.doc)
+		}
+		result = formatImportSpec(result, spec)
+	}
+	return append(result, ')', '\n', '\n')
+}
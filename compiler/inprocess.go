@@ -0,0 +1,16 @@
+//go:build (linux || darwin || freebsd) && cgo
+// +build linux darwin freebsd
+// +build cgo
+
+package compiler
+
+import "plugin"
+
+// openInProcess loads the plugin file into the compiler process.
+func openInProcess(file string) (inProcessPlugin, error) {
+	p, err := plugin.Open(file)
+	if err != nil {
+		return inProcessPlugin{}, err
+	}
+	return inProcessPlugin{func(name string) (interface{}, error) { return p.Lookup(name) }}, nil
+}
@@ -0,0 +1,19 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+// +build !linux,!darwin,!freebsd !cgo
+
+package compiler
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errPluginsUnsupported = errors.New("plugins unsupported on this platform; use the subprocess backend")
+
+// openInProcess reports that plugins cannot be loaded into the compiler
+// process. Plugins can still be loaded into plugin host processes started
+// from Config.PluginHostExecutable, if that is built for a platform with
+// plugin support.
+func openInProcess(file string) (inProcessPlugin, error) {
+	return inProcessPlugin{}, fmt.Errorf("%v: %w", file, errPluginsUnsupported)
+}
@@ -0,0 +1,43 @@
+package compiler
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolatePluginHost starts the plugin host process in new user, network
+// and mount namespaces. The new network namespace only has an unconfigured
+// loopback interface.
+func isolatePluginHost(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+	cmd.Env = append(os.Environ(), isolatedHostEnv+"=1")
+	return nil
+}
+
+// enterIsolation changes the root directory of the plugin host process to
+// an empty directory that is removed right away, so that no files can be
+// accessed or created anymore.
+func enterIsolation() error {
+	dir, err := ioutil.TempDir("", "slick-plugin-host")
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		os.Remove(dir)
+		return err
+	}
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+	return syscall.Chroot(".")
+}
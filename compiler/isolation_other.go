@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package compiler
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errIsolationUnsupported = errors.New("isolated macro execution is only supported on Linux")
+
+func isolatePluginHost(cmd *exec.Cmd) error {
+	return errIsolationUnsupported
+}
+
+func enterIsolation() error {
+	return errIsolationUnsupported
+}
@@ -0,0 +1,247 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+/*
+A plugin may enumerate the macros it exports in a manifest. When it
+does, use declarations of the plugin check the manifest eagerly, and
+invocations of macros that the plugin does not export, or with a number
+of arguments that does not fit the shape of the macro, are reported
+before the macro is looked up. Plugins without a manifest remain
+supported, but their macros are only checked when they are invoked.
+*/
+
+// A MacroInfo describes a macro in the manifest of a plugin.
+type MacroInfo struct {
+	// Name is the name of the macro function.
+	Name string
+	// Shape is an optional hint for the shape of invocations of the
+	// macro, as a form that starts with the name of the macro, followed
+	// by one element per argument. An element followed by ... stands for
+	// any number of arguments, as in "(Let ((name value) ...) body ...)".
+	Shape string
+	// Doc is an optional description of the macro.
+	Doc string
+}
+
+// A Manifest enumerates the macros exported by a plugin. A plugin
+// provides its manifest as an exported variable named Manifest of type
+// Manifest.
+type Manifest []MacroInfo
+
+// macroArity is the number of arguments a macro accepts, with max < 0 if
+// there is no upper limit.
+type macroArity struct {
+	min, max int
+	shape    string
+}
+
+// A manifest is a Manifest that has been checked, with the arities of
+// the macros that have a shape.
+type manifest struct {
+	Manifest
+	arities map[string]macroArity
+	names   []string
+}
+
+// parseShape returns the arity of the macro with the given shape.
+func parseShape(name, shape string) (macroArity, error) {
+	rd, err := reader.NewReader(nil, "shape", shape, nil)
+	if err != nil {
+		return macroArity{}, err
+	}
+	rd.SkipSpace()
+	form, ok := rd.Read().(*list.Pair)
+	rd.SkipSpace()
+	if err := rd.Errors.Err(); err != nil {
+		return macroArity{}, err
+	}
+	if !ok || form == nil || !list.IsProper(form) || rd.Read() != io.EOF {
+		return macroArity{}, fmt.Errorf("shape of %v is not a single list: %v", name, shape)
+	}
+	if head, ok := form.Car.(*lib.Symbol); !ok || head.Identifier != name {
+		return macroArity{}, fmt.Errorf("shape of %v does not start with its name: %v", name, shape)
+	}
+	arity := macroArity{shape: shape}
+	args := form.Cdr.(*list.Pair).ToSlice()
+	for i, arg := range args {
+		switch {
+		case arg == _ellipsis:
+			if i == 0 || args[i-1] == _ellipsis {
+				return macroArity{}, fmt.Errorf("misplaced ... in shape of %v: %v", name, shape)
+			}
+			arity.max = -1
+		case i+1 < len(args) && args[i+1] == _ellipsis:
+		default:
+			arity.min++
+		}
+	}
+	if arity.max == 0 {
+		arity.max = arity.min
+	}
+	return arity, nil
+}
+
+// checkManifest checks the manifest of a plugin, and records the arities
+// of its macros.
+func checkManifest(m Manifest) (*manifest, error) {
+	checked := &manifest{Manifest: m, arities: make(map[string]macroArity)}
+	seen := make(map[string]bool, len(m))
+	for _, info := range m {
+		if info.Name == "" {
+			return nil, errors.New("macro without name")
+		}
+		if seen[info.Name] {
+			return nil, fmt.Errorf("duplicate macro %v", info.Name)
+		}
+		seen[info.Name] = true
+		checked.names = append(checked.names, info.Name)
+		if info.Shape == "" {
+			continue
+		}
+		arity, err := parseShape(info.Name, info.Shape)
+		if err != nil {
+			return nil, err
+		}
+		checked.arities[info.Name] = arity
+	}
+	sort.Strings(checked.names)
+	return checked, nil
+}
+
+// Arity returns the minimum and maximum number of arguments of the macro
+// according to its shape, with max < 0 if there is no upper limit. A macro
+// without a shape accepts any number of arguments.
+func (info MacroInfo) Arity() (min, max int, err error) {
+	if info.Shape == "" {
+		return 0, -1, nil
+	}
+	arity, err := parseShape(info.Name, info.Shape)
+	return arity.min, arity.max, err
+}
+
+// Check reports an error if the manifest is invalid, because a macro has
+// no name, a name occurs more than once, or a shape is malformed. The
+// compiler only checks a manifest when the plugin is used, so plugins can
+// call Check in their own tests instead.
+func (m Manifest) Check() error {
+	_, err := checkManifest(m)
+	return err
+}
+
+// exports reports whether the plugin exports the macro according to its
+// manifest.
+func (m *manifest) exports(name string) bool {
+	i := sort.SearchStrings(m.names, name)
+	return i < len(m.names) && m.names[i] == name
+}
+
+// manifests caches the checked manifests of plugins that are loaded into
+// the compiler process, which cannot change.
+var manifests sync.Map // *Manifest -> *manifest or error
+
+func (p inProcessPlugin) lookupManifest() (*manifest, error) {
+	sym, err := p.lookup("Manifest")
+	if err != nil {
+		return nil, nil
+	}
+	m, ok := sym.(*Manifest)
+	if !ok {
+		return nil, errors.New("Manifest is not of type compiler.Manifest")
+	}
+	if cached, ok := manifests.Load(m); ok {
+		if err, ok := cached.(error); ok {
+			return nil, err
+		}
+		return cached.(*manifest), nil
+	}
+	checked, err := checkManifest(*m)
+	if err != nil {
+		manifests.Store(m, err)
+		return nil, err
+	}
+	manifests.Store(m, checked)
+	return checked, nil
+}
+
+// checkPluginManifest reports an error if the manifest of the plugin is
+// invalid, or lists macros that the plugin does not export.
+func (cmp *compiler) checkPluginManifest(form *list.Pair, p macroProvider) {
+	m, err := p.lookupManifest()
+	if err != nil {
+		cmp.error(form, fmt.Sprintf("invalid plugin manifest: %v", err))
+		return
+	}
+	if m == nil {
+		return
+	}
+	for _, name := range m.names {
+		if _, err := p.lookupMacro(name); err != nil {
+			cmp.error(form, fmt.Sprintf("invalid plugin manifest: %v", err))
+			return
+		}
+	}
+}
+
+// checkMacroInvocation reports an error if the invocation of the macro
+// does not fit the manifest of the plugin.
+func (cmp *compiler) checkMacroInvocation(form, e *list.Pair, sym *lib.Symbol, p macroProvider) bool {
+	m, err := p.lookupManifest()
+	if err != nil {
+		cmp.error(form, fmt.Sprintf("invalid plugin manifest: %v", err))
+		return false
+	}
+	if m == nil {
+		return true
+	}
+	if !m.exports(sym.Identifier) {
+		cmp.error(form, fmt.Sprintf("unknown macro %v, plugin exports: %v", sym.Identifier, strings.Join(m.names, ", ")))
+		return false
+	}
+	arity, ok := m.arities[sym.Identifier]
+	if !ok {
+		return true
+	}
+	if n := e.Length() - 1; n < arity.min || (arity.max >= 0 && n > arity.max) {
+		cmp.error(form, fmt.Sprintf("invalid number of arguments for macro %v, expected %v", sym.Identifier, arity.shape))
+		return false
+	}
+	return true
+}
+
+// PluginManifest returns the manifest of the plugin with the given import
+// path, or nil if the plugin does not provide a manifest. Tools can use
+// it to list the macros of a plugin, for example for documentation or for
+// completion of macro names.
+func PluginManifest(path string) (Manifest, error) {
+	return Config{}.PluginManifest(path)
+}
+
+// PluginManifest returns the manifest of the plugin with the given import
+// path, which is loaded with the given configuration.
+func (config Config) PluginManifest(path string) (Manifest, error) {
+	file, err := config.pluginFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := config.loadPlugin(file)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.lookupManifest()
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return append(Manifest(nil), m.Manifest...), nil
+}
@@ -0,0 +1,41 @@
+package compiler
+
+import "go/token"
+
+/*
+The compiler translates one file at a time. In package mode, the files
+of a package are compiled one after the other with the same Package in
+their Config, which collects the top-level definitions of the files, so
+that a redefinition in another file of the package is reported with the
+positions of both definitions, just like a redefinition within a file.
+*/
+
+// A Package collects the top-level definitions of the files of a package
+// that are compiled with it. The zero Package has no definitions. A
+// Package must not be used by concurrent compilations.
+type Package struct {
+	definitions map[string]token.Position
+}
+
+// forget removes the definitions of file, so that a file can be compiled
+// again with the same Package, for example in watch mode.
+func (pkg *Package) forget(file string) {
+	for name, pos := range pkg.definitions {
+		if pos.Filename == file {
+			delete(pkg.definitions, name)
+		}
+	}
+}
+
+// define records the definition of name at pos, and returns the position
+// of a previous definition in another file, if any.
+func (pkg *Package) define(name string, pos token.Position) (token.Position, bool) {
+	if previous, ok := pkg.definitions[name]; ok {
+		return previous, true
+	}
+	if pkg.definitions == nil {
+		pkg.definitions = make(map[string]token.Position)
+	}
+	pkg.definitions[name] = pos
+	return token.Position{}, false
+}
@@ -0,0 +1,419 @@
+package compiler_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pcostanza/slick/compiler"
+	"github.com/pcostanza/slick/reader"
+)
+
+// raceEnabled reports whether the tests run with the race detector.
+var raceEnabled bool
+
+// testPlugins holds the plugins built from testdata, which are shared by
+// all tests, since building a plugin takes a while.
+var testPlugins struct {
+	sync.Mutex
+	dir    string
+	config compiler.Config
+	err    error
+}
+
+// TestMain serves as plugin host process when the test binary is
+// started as one, see Config.UsePluginHosts.
+func TestMain(m *testing.M) {
+	if len(os.Args) == 3 && os.Args[1] == compiler.PluginHostFlag {
+		if err := compiler.ServePluginHost(os.Args[2], os.NewFile(3, "in"), os.NewFile(4, "out")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	code := m.Run()
+	if testPlugins.dir != "" {
+		os.RemoveAll(testPlugins.dir)
+	}
+	os.Exit(code)
+}
+
+// pluginConfig returns a Config whose core plugin is the plugin in
+// testdata/quoteplugin, and whose plugins with import paths
+// example.com/macros and example.com/bang are the plugins in
+// testdata/macroplugin and testdata/readerplugin. The plugins
+// are built with the same instrumentation as the test binary, so that
+// the test binary can load them. The test is skipped if the plugins
+// cannot be built or loaded.
+func pluginConfig(t *testing.T) compiler.Config {
+	t.Helper()
+	testPlugins.Lock()
+	defer testPlugins.Unlock()
+	if testPlugins.dir == "" && testPlugins.err == nil {
+		testPlugins.config, testPlugins.err = buildTestPlugins()
+	}
+	if testPlugins.err != nil {
+		t.Skipf("cannot build the test plugins: %v", testPlugins.err)
+	}
+	return testPlugins.config
+}
+
+func buildTestPlugins() (config compiler.Config, err error) {
+	dir, err := os.MkdirTemp("", "slick-test-plugins")
+	if err != nil {
+		return config, err
+	}
+	testPlugins.dir = dir
+	config.SlickRoot = filepath.Join(dir, "root")
+	config.SlickPath = filepath.Join(dir, "path")
+	args := []string{"build", "-buildmode=plugin"}
+	if raceEnabled {
+		args = append(args, "-race")
+	}
+	if mode := testing.CoverMode(); mode != "" {
+		args = append(args, "-covermode="+mode, "-coverpkg=github.com/pcostanza/slick/compiler")
+	}
+	for pkg, file := range map[string]string{
+		"./testdata/quoteplugin":  filepath.Join(config.SlickRoot, "plugins", "plugin.so"),
+		"./testdata/macroplugin":  filepath.Join(config.SlickPath, "plugins", "example.com", "macros", "slick", "plugin.so"),
+		"./testdata/readerplugin": filepath.Join(config.SlickPath, "plugins", "example.com", "bang", "slick", "plugin.so"),
+	} {
+		build := exec.Command("go", append(args, "-o", file, pkg)...)
+		if out, err := build.CombinedOutput(); err != nil {
+			return config, fmt.Errorf("%v\n%s", err, out)
+		}
+	}
+	// Coverage of other packages than the compiler changes them in the
+	// test binary, so that it cannot load the plugins.
+	rd, err := reader.NewReader(nil, "probe.slick", "(package p) (use \"example.com/macros\") (var (x := '(a)))", nil)
+	if err != nil {
+		return config, err
+	}
+	if _, err := config.Compile(rd); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func compileResult(t *testing.T, config compiler.Config, src string) (string, error) {
+	t.Helper()
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Compile(rd)
+	return string(result), err
+}
+
+func TestPluginHosts(t *testing.T) {
+	inProcess := pluginConfig(t)
+	hosted := inProcess
+	hosted.UsePluginHosts = true
+	t.Run("Round trip", func(t *testing.T) {
+		src := `(package p) (import "strings") (use "example.com/macros")
+(var (x := (macros:Echo a strings:Join :c 123456789012345678901234567890 #\x 2.5i 1.5 "s" (d . e) ((f (g))))))`
+		args := `(a strings:Join :c *big.Int(123456789012345678901234567890) int32(120) complex128((0+2.5i)) float64(1.5) string(s) (d . e) ((f (g))))`
+		expected := strconv.Quote("(" + args + " complex128((1-2i)) int(42) float64(1.5) bool(true) (string(a) . string(b)) " + args + ")")
+		for name, config := range map[string]compiler.Config{"in process": inProcess, "hosted": hosted} {
+			if result := compileWith(t, config, src); !strings.Contains(result, expected) {
+				t.Errorf("%v: %v not found in:\n%s", name, expected, result)
+			}
+		}
+	})
+	t.Run("Processes", func(t *testing.T) {
+		src := `(package p) (use "example.com/macros") (const (pid := (macros:Pid)))`
+		pid := func(config compiler.Config) string {
+			t.Helper()
+			result := compileWith(t, config, src)
+			i := strings.Index(result, "pid = ")
+			if i < 0 {
+				t.Fatalf("no pid in:\n%s", result)
+			}
+			return strings.Fields(result[i+len("pid = "):])[0]
+		}
+		if p := pid(inProcess); p != strconv.Itoa(os.Getpid()) {
+			t.Errorf("in-process macro runs in process %v", p)
+		}
+		host := pid(hosted)
+		if host == strconv.Itoa(os.Getpid()) {
+			t.Errorf("hosted macro runs in the compiler process")
+		}
+		if p := pid(hosted); p != host {
+			t.Errorf("plugin host %v restarted as %v without a change of the plugin", host, p)
+		}
+		file := filepath.Join(hosted.SlickPath, "plugins", "example.com", "macros", "slick", "plugin.so")
+		found := false
+		for _, f := range compiler.PluginHostFiles() {
+			found = found || f == file
+		}
+		if !found {
+			t.Errorf("%v not among the plugin host files %v", file, compiler.PluginHostFiles())
+		}
+		later := time.Now().Add(time.Hour)
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if p := pid(hosted); p == host {
+			t.Errorf("plugin host %v not restarted after a change of the plugin", host)
+		}
+	})
+	t.Run("Errors", func(t *testing.T) {
+		src := `(package p) (use "example.com/macros") (var (x := (macros:Fail "macro failed on purpose")))`
+		for name, config := range map[string]compiler.Config{"in process": inProcess, "hosted": hosted} {
+			_, err := compileResult(t, config, src)
+			if err == nil || !strings.Contains(err.Error(), "test.slick:1:45: ") || !strings.Contains(err.Error(), "macro failed on purpose") {
+				t.Errorf("%v: unexpected error %v", name, err)
+			}
+		}
+	})
+}
+
+func TestMacroPolicy(t *testing.T) {
+	config := pluginConfig(t)
+	t.Run("Expansion limit", func(t *testing.T) {
+		count := func(config compiler.Config, n int) error {
+			t.Helper()
+			_, err := compileResult(t, config, fmt.Sprintf(`(package p) (use "example.com/macros") (const (x := (macros:Count %v)))`, n))
+			return err
+		}
+		limited := config
+		limited.Macros.MaxExpansions = 5
+		if err := count(limited, 4); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := count(limited, 5); err == nil || !strings.Contains(err.Error(), "more than 5 macro expansions in a single top-level declaration, last by macro Count while expanding (#example.com/macros:Count 0)") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if err := count(config, compiler.DefaultMaxExpansions); err == nil || !strings.Contains(err.Error(), "more than 10000 macro expansions") {
+			t.Errorf("unexpected error %v", err)
+		}
+		unlimited := config
+		unlimited.Macros.MaxExpansions = -1
+		if err := count(unlimited, compiler.DefaultMaxExpansions); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		timed := config
+		timed.Macros.Timeout = 50 * time.Millisecond
+		hosted := timed
+		hosted.UsePluginHosts = true
+		for name, config := range map[string]compiler.Config{"in process": timed, "hosted": hosted} {
+			_, err := compileResult(t, config, `(package p) (use "example.com/macros") (const (x := (macros:Sleep 1000)))`)
+			if err == nil || !strings.Contains(err.Error(), "macro Sleep timed out after 50ms while expanding (#example.com/macros:Sleep 1000)") {
+				t.Errorf("%v: unexpected error %v", name, err)
+			}
+			if _, err := compileResult(t, config, `(package p) (use "example.com/macros") (const (x := (macros:Sleep 1)))`); err != nil {
+				t.Errorf("%v: unexpected error %v after timeout", name, err)
+			}
+		}
+	})
+	t.Run("Isolation", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("macros can only be isolated on Linux")
+		}
+		file := filepath.Join(t.TempDir(), "data")
+		if err := os.WriteFile(file, []byte("secret"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		src := fmt.Sprintf(`(package p) (use "example.com/macros") (const (x := (macros:ReadFile %q)))`, file)
+		if result, err := compileResult(t, config, src); err != nil || !strings.Contains(result, `"secret"`) {
+			t.Errorf("unexpected result %v:\n%s", err, result)
+		}
+		isolated := config
+		isolated.Macros.Isolated = true
+		_, err := compileResult(t, isolated, src)
+		if err != nil && strings.Contains(err.Error(), "failed to start") {
+			t.Skipf("cannot start isolated plugin hosts: %v", err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "no such file or directory") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestMacroCache(t *testing.T) {
+	config := pluginConfig(t)
+	values := func(config compiler.Config, src string) []string {
+		t.Helper()
+		result := compileWith(t, config, `(package p) (use "example.com/macros") `+src)
+		var values []string
+		for _, line := range strings.Split(result, "\n") {
+			if i := strings.Index(line, " = "); i >= 0 {
+				values = append(values, strings.TrimSpace(line[i+len(" = "):]))
+			}
+		}
+		return values
+	}
+	t.Run("Within a file", func(t *testing.T) {
+		v := values(config, `(const (a := (macros:Calls)) (b := (macros:Calls)) (c := (macros:Calls 1)))`)
+		if len(v) != 3 || v[0] != v[1] || v[0] == v[2] {
+			t.Errorf("repeated form not cached, or different forms cached together: %v", v)
+		}
+		for _, name := range []string{"Fresh", "Imported"} {
+			v := values(config, fmt.Sprintf(`(const (a := (macros:%[1]v)) (b := (macros:%[1]v)))`, name))
+			if len(v) != 2 || v[0] == v[1] {
+				t.Errorf("%v cached: %v", name, v)
+			}
+		}
+	})
+	t.Run("Across compilations", func(t *testing.T) {
+		src := `(const (a := (macros:Calls 2)))`
+		if first, second := values(config, src), values(config, src); first[0] == second[0] {
+			t.Errorf("expansion cached without a shared cache: %v", first)
+		}
+		shared := config
+		shared.Cache = compiler.NewMacroCache(0)
+		if first, second := values(shared, src), values(shared, src); first[0] != second[0] {
+			t.Errorf("expansion not cached in a shared cache: %v %v", first, second)
+		}
+	})
+	t.Run("Eviction", func(t *testing.T) {
+		shared := config
+		shared.Cache = compiler.NewMacroCache(2)
+		first := values(shared, `(const (a := (macros:Calls 3)) (b := (macros:Calls 4)))`)
+		second := values(shared, `(const (a := (macros:Calls 3)) (b := (macros:Calls 4)) (c := (macros:Calls 5)))`)
+		third := values(shared, `(const (b := (macros:Calls 4)) (a := (macros:Calls 3)))`)
+		if first[0] != second[0] || first[1] != second[1] {
+			t.Errorf("expansions evicted too early: %v %v", first, second)
+		}
+		if third[0] != first[1] || third[1] == first[0] {
+			t.Errorf("oldest expansion not evicted: %v %v", first, third)
+		}
+	})
+}
+
+func TestMacroEnvironment(t *testing.T) {
+	inProcess := pluginConfig(t)
+	hosted := inProcess
+	hosted.UsePluginHosts = true
+	for name, config := range map[string]compiler.Config{"in process": inProcess, "hosted": hosted} {
+		t.Run(name, func(t *testing.T) {
+			result := compileWith(t, config, `(package p) (use "example.com/macros") (var (x := (macros:Helper "os")) (y := 1))`)
+			if !strings.Contains(result, `_ "os"`) {
+				t.Errorf("import not added:\n%s", result)
+			}
+			if n := strings.Count(result, "helper = 42"); n != 1 {
+				t.Errorf("emitted declaration found %v times:\n%s", n, result)
+			}
+			if i, j := strings.Index(result, "y = 1"), strings.Index(result, "helper = 42"); i < 0 || j < i {
+				t.Errorf("emitted declaration not after the declaration that contains the macro invocation:\n%s", result)
+			}
+			rd, err := reader.NewReader(nil, "test.slick", `(package p) (use "example.com/macros")
+(var (x := (macros:Report
+            (warn here)
+            (fail there))))`, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = config.Compile(rd)
+			if err == nil || !strings.Contains(err.Error(), "test.slick:4:13: failed on purpose") {
+				t.Errorf("unexpected error %v", err)
+			}
+			if len(rd.Warnings) != 1 || rd.Warnings[0].Error() != "test.slick:3:13: warned on purpose" {
+				t.Errorf("unexpected warnings %v", rd.Warnings)
+			}
+		})
+	}
+}
+
+func TestReaderMacros(t *testing.T) {
+	config := pluginConfig(t)
+	t.Run("Dispatch", func(t *testing.T) {
+		src := `(package p) (use (_ "example.com/bang")) (var (x := #!(a b)))`
+		if result := compileWith(t, config, src); !strings.Contains(result, `quoted("(a b)")`) {
+			t.Errorf("#! does not read as quote:\n%s", result)
+		}
+	})
+	t.Run("Missing", func(t *testing.T) {
+		_, err := compileResult(t, config, `(package p) (var (x := #!(a b))) (use (_ "example.com/bang"))`)
+		if err == nil || !strings.Contains(err.Error(), "test.slick:1:24: invalid dispatch macro rune") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+	t.Run("Duplicate", func(t *testing.T) {
+		_, err := compileResult(t, config, `(package p) (use (_ "example.com/bang") (_ "example.com/bang"))`)
+		if err == nil || !strings.Contains(err.Error(), "error during reader macro installation: duplicate reader macro #!") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+// TestDottedForms checks that dotted lists, which the reader cannot read
+// but macros can return, are reported as errors in every kind of form.
+func TestDottedForms(t *testing.T) {
+	config := pluginConfig(t)
+	for _, src := range []string{
+		`(type (T (struct . x)))`,
+		`(type (T (struct (a . int))))`,
+		`(type (T (struct (a :type . int))))`,
+		`(type (T (interface . x)))`,
+		`(type (T (interface (M . x))))`,
+		`(type (T (interface (M () . x))))`,
+		`(type (T (chan . int)))`,
+		`(type (T (func (a . int))))`,
+		`(type (T (func ((a . int)))))`,
+		`(type (T (map int . int)))`,
+		`(type T . int)`,
+		`(type (T . int))`,
+		`(var (x . y))`,
+		`(var (x := . 1))`,
+		`(const (x := 1 . 2))`,
+		`(import . "fmt")`,
+		`(func . f)`,
+		`(func f . x)`,
+		`(func f () . x)`,
+		`(func f () () . x)`,
+		`(func f ((a . int)) ())`,
+		`(func f () () (switch 1 (1 . x)))`,
+		`(func f () () (switch 1 ((1 . 2) 3)))`,
+		`(func f () () (switch 1 (1 :when . x)))`,
+		`(func f () () (switch 1 (1 :when true . x)))`,
+		`(func f () () (switch 1 . x))`,
+		`(func f () () (type-switch x 1 (int . x)))`,
+		`(func f () () (select (x . y)))`,
+		`(func f () () (if true . x))`,
+		`(func f () () (for . x))`,
+		`(func f () () (range (:= x . xs)))`,
+		`(func f () () (:= x . 1))`,
+		`(func f () () (= x . 1))`,
+		`(func f () () (print (slot x . y)))`,
+		`(func f () () (print (make-struct T . x)))`,
+		`(func f () () (print (make-map (map int int) . x)))`,
+		`(func f () () (print (make . x)))`,
+		`(func f () () (print (+ 1 . 2)))`,
+		`(func f () () (print (convert 1 . int)))`,
+		`(func f () () (print (assert x . int)))`,
+		`(func f () () (print (func () . x)))`,
+		`(func f () () (print (func () () . x)))`,
+		`(func f () () (print (if-expr true 1 . 2)))`,
+		`(func f () () (print (quote . x)))`,
+		`(func f () () (print (quasiquote . x)))`,
+		`(func f () () (print (splice 1 . 2)))`,
+		`(func f () () (return . x))`,
+		`(func f () () (go . x))`,
+		`(func f () () (defer f . x))`,
+		`(func f () () (break . x))`,
+		`(func f () () (goto . x))`,
+		`(func f () () (loop . x))`,
+		`(func f () () (while true . x))`,
+		`(func f () () (begin . x))`,
+		`(func f () () (declare . x))`,
+		`(func f () () (:=# x . 1))`,
+		`(define-constant x . 1)`,
+		`(define-constant x (github.com/pcostanza/slick/list:List 1 . 2))`,
+		`(init . x)`,
+		`(declare . x)`,
+	} {
+		if _, err := compileResult(t, config, `(package p) (use "example.com/macros") (macros:Dotted `+src+`)`); err == nil {
+			t.Errorf("no error for %v", src)
+		}
+	}
+}
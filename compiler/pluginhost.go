@@ -0,0 +1,548 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Go plugins cannot be unloaded, and plugin.Open cannot reload a plugin
+binary that has changed after it was loaded. For watch mode, plugins can
+therefore be loaded into plugin host processes instead, one per plugin
+binary. Whenever a plugin binary changes, its host process is stopped,
+and a new one is started on the next macro invocation.
+
+A plugin host process is the compiler executable itself, invoked with
+the -plugin-host flag and the plugin binary as arguments. It receives
+requests on file descriptor 3, and sends responses on file descriptor 4,
+so that output of macro functions to stdout and stderr does not
+interfere with the protocol. See ServePluginHost.
+
+During a macro call, the plugin host forwards calls of Environment
+methods to the compiler. The gensym counters of the compiler and of the
+plugin host are synchronized before and after each macro call, so that
+symbols created by lib.Gensym remain unique.
+
+When the timeout of the macro policy is exceeded during a macro call,
+the plugin host process is stopped. When the policy isolates macros,
+the plugin host process is started in a sandbox without access to the
+filesystem and the network, which it enters after it has loaded the
+plugin binary.
+*/
+
+// PluginHostFlag is the command-line flag with which the compiler executable
+// is invoked to start a plugin host process.
+const PluginHostFlag = "-plugin-host"
+
+// isolatedHostEnv is the environment variable that tells a plugin host
+// process to enter its sandbox.
+const isolatedHostEnv = "SLICK_PLUGIN_HOST_ISOLATED"
+
+const (
+	msgReady byte = iota
+	msgLookup
+	msgCall
+	msgImport
+	msgEmit
+	msgError
+	msgWarning
+	msgReply
+	msgResult
+)
+
+type (
+	macroProvider interface {
+		lookupMacro(name string) (macro, error)
+		lookupReaderMacros() (readerMacros, bool, error)
+		lookupManifest() (*manifest, error)
+	}
+
+	// An inProcessPlugin is a plugin that is loaded into the compiler
+	// process, see openInProcess.
+	inProcessPlugin struct {
+		lookup func(name string) (interface{}, error)
+	}
+
+	pluginHost struct {
+		sync.Mutex
+		file         string
+		stamp        pluginStamp
+		exe          string
+		cmd          *exec.Cmd
+		pipes        []*os.File
+		conn         *hostConn
+		readerMacros bool
+		manifest     *manifest
+		manifestErr  error
+		isolated     bool
+	}
+)
+
+func lookupMacro(p inProcessPlugin, name string) (macro, error) {
+	sym, err := p.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(macro)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a macro function", name)
+	}
+	return fn, nil
+}
+
+func (p inProcessPlugin) lookupMacro(name string) (macro, error) {
+	fn, err := lookupMacro(p, name)
+	if err != nil {
+		return nil, err
+	}
+	return withTimeout(name, fn), nil
+}
+
+func (p inProcessPlugin) lookupReaderMacros() (readerMacros, bool, error) {
+	sym, err := p.lookup("ReaderMacros")
+	if err != nil {
+		return nil, false, nil
+	}
+	install, ok := sym.(readerMacros)
+	if !ok {
+		return nil, true, errors.New("invalid reader macros in plugin")
+	}
+	return install, true, nil
+}
+
+var pluginHosts = struct {
+	sync.Mutex
+	hosts map[string]*pluginHost
+}{hosts: make(map[string]*pluginHost)}
+
+// openPluginHost returns the running plugin host for the plugin file, and
+// starts a new one from the executable exe if necessary.
+func openPluginHost(file, exe string, isolated bool) (*pluginHost, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	pluginHosts.Lock()
+	defer pluginHosts.Unlock()
+	h := pluginHosts.hosts[file]
+	if h != nil {
+		h.Lock()
+		current := h.conn != nil && h.exe == exe && h.isolated == isolated &&
+			h.stamp.size == info.Size() && h.stamp.modTime.Equal(info.ModTime())
+		if !current {
+			h.stop()
+		}
+		h.Unlock()
+		if current {
+			return h, nil
+		}
+	}
+	h = &pluginHost{file: file, exe: exe, stamp: pluginStamp{size: info.Size(), modTime: info.ModTime()}, isolated: isolated}
+	if err := h.start(); err != nil {
+		return nil, err
+	}
+	pluginHosts.hosts[file] = h
+	return h, nil
+}
+
+// PluginHostFiles returns the plugin binaries for which plugin host
+// processes are currently running.
+func PluginHostFiles() (files []string) {
+	pluginHosts.Lock()
+	defer pluginHosts.Unlock()
+	for file, h := range pluginHosts.hosts {
+		h.Lock()
+		if h.conn != nil {
+			files = append(files, file)
+		}
+		h.Unlock()
+	}
+	sort.Strings(files)
+	return
+}
+
+func (h *pluginHost) start() error {
+	exe := h.exe
+	if exe == "" {
+		var err error
+		if exe, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	parentIn, childOut, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	childIn, parentOut, err := os.Pipe()
+	if err != nil {
+		parentIn.Close()
+		childOut.Close()
+		return err
+	}
+	cmd := exec.Command(exe, PluginHostFlag, h.file)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{childIn, childOut}
+	if h.isolated {
+		err = isolatePluginHost(cmd)
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	childIn.Close()
+	childOut.Close()
+	if err != nil {
+		parentIn.Close()
+		parentOut.Close()
+		return err
+	}
+	h.cmd = cmd
+	h.pipes = []*os.File{parentIn, parentOut}
+	h.conn = newHostConn(parentIn, parentOut)
+	if kind := h.conn.readByte(); kind != msgReady && h.conn.err == nil {
+		h.conn.fail(fmt.Errorf("unexpected message %v", kind))
+	}
+	err = h.conn.readError()
+	if err == nil {
+		h.readerMacros = h.conn.readByte() != 0
+		h.manifest, h.manifestErr = h.conn.readManifest()
+	}
+	if h.conn.err != nil {
+		err = h.conn.err
+	}
+	if err != nil {
+		h.stop()
+		return fmt.Errorf("plugin host for %v failed to start: %v", h.file, err)
+	}
+	return nil
+}
+
+func (h *pluginHost) stop() {
+	if h.cmd == nil {
+		return
+	}
+	h.cmd.Process.Kill()
+	h.cmd.Wait()
+	for _, pipe := range h.pipes {
+		pipe.Close()
+	}
+	h.cmd = nil
+	h.pipes = nil
+	h.conn = nil
+}
+
+func (h *pluginHost) failed(err error) error {
+	h.stop()
+	return fmt.Errorf("plugin host for %v failed: %v", h.file, err)
+}
+
+func (h *pluginHost) lookupMacro(name string) (macro, error) {
+	h.Lock()
+	defer h.Unlock()
+	c := h.conn
+	if c == nil {
+		return nil, fmt.Errorf("plugin host for %v is not running", h.file)
+	}
+	c.writeByte(msgLookup)
+	c.writeString(name)
+	if err := c.flush(); err != nil {
+		return nil, h.failed(err)
+	}
+	if kind := c.readByte(); kind != msgReply && c.err == nil {
+		return nil, h.failed(fmt.Errorf("unexpected message %v", kind))
+	}
+	if err := c.readError(); c.err != nil {
+		return nil, h.failed(c.err)
+	} else if err != nil {
+		return nil, err
+	}
+	return func(form *list.Pair, env Environment) (interface{}, error) {
+		return h.call(name, form, env)
+	}, nil
+}
+
+func (h *pluginHost) lookupManifest() (*manifest, error) {
+	return h.manifest, h.manifestErr
+}
+
+// writeManifest sends the manifest of a plugin, which is checked again
+// by readManifest.
+func (c *hostConn) writeManifest(m *manifest, err error) {
+	c.writeError(err)
+	if m == nil {
+		c.writeByte(0)
+		return
+	}
+	c.writeByte(1)
+	c.writeUvarint(uint64(len(m.Manifest)))
+	for _, info := range m.Manifest {
+		c.writeString(info.Name)
+		c.writeString(info.Shape)
+		c.writeString(info.Doc)
+	}
+}
+
+func (c *hostConn) readManifest() (*manifest, error) {
+	if err := c.readError(); err != nil || c.readByte() == 0 {
+		return nil, err
+	}
+	n := c.readUvarint()
+	var m Manifest
+	for i := uint64(0); i < n && c.err == nil; i++ {
+		m = append(m, MacroInfo{Name: c.readString(), Shape: c.readString(), Doc: c.readString()})
+	}
+	if c.err != nil {
+		return nil, nil
+	}
+	return checkManifest(m)
+}
+
+var errReaderMacrosInHost = errors.New("reader macros are not installed from plugins in plugin hosts")
+
+func (h *pluginHost) lookupReaderMacros() (readerMacros, bool, error) {
+	if h.readerMacros {
+		return nil, true, errReaderMacrosInHost
+	}
+	return nil, false, nil
+}
+
+func (h *pluginHost) call(name string, form *list.Pair, env Environment) (newForm interface{}, err error) {
+	h.Lock()
+	defer h.Unlock()
+	c := h.conn
+	if c == nil {
+		return nil, fmt.Errorf("plugin host for %v is not running", h.file)
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			h.stop()
+		}
+	}()
+	failed := h.failed
+	if timeout := env.cmp.config.Macros.Timeout; timeout > 0 {
+		var timedOut int32
+		process := h.cmd.Process
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			process.Kill()
+		})
+		defer func() {
+			if !timer.Stop() {
+				h.stop()
+			}
+		}()
+		failed = func(err error) error {
+			if atomic.LoadInt32(&timedOut) != 0 {
+				h.stop()
+				return timeoutError(name, timeout, form)
+			}
+			return h.failed(err)
+		}
+	}
+	c.forms = newFormTable()
+	c.writeByte(msgCall)
+	c.writeString(name)
+	c.writeVarint(lib.GensymCounter())
+	if err := c.writeForm(form); err != nil {
+		c.buf.Reset()
+		completed = true
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		return nil, failed(err)
+	}
+	for {
+		switch kind := c.readByte(); kind {
+		case msgImport:
+			path := c.readString()
+			alias := c.readString()
+			if c.err != nil {
+				break
+			}
+			name, err := env.RequireImport(path, alias)
+			c.writeByte(msgReply)
+			c.writeString(name)
+			c.writeError(err)
+			if err := c.flush(); err != nil {
+				return nil, failed(err)
+			}
+		case msgEmit:
+			decl := c.readForm()
+			if c.err != nil {
+				break
+			}
+			err := errors.New("emitted top-level declaration is not a list")
+			if pair, ok := decl.(*list.Pair); ok {
+				err = env.EmitTopLevel(pair)
+			}
+			c.writeByte(msgReply)
+			c.writeError(err)
+			if err := c.flush(); err != nil {
+				return nil, failed(err)
+			}
+		case msgError, msgWarning:
+			subform := c.readForm()
+			msg := c.readString()
+			if c.err != nil {
+				break
+			}
+			if kind == msgError {
+				env.Errorf(subform, "%s", msg)
+			} else {
+				env.Warnf(subform, "%s", msg)
+			}
+		case msgResult:
+			counter := c.readVarint()
+			newForm = c.readForm()
+			err = c.readError()
+			if c.err != nil {
+				break
+			}
+			lib.AdvanceGensymCounter(counter)
+			completed = true
+			return newForm, err
+		default:
+			c.fail(fmt.Errorf("unexpected message %v", kind))
+		}
+		if c.err != nil {
+			return nil, failed(c.err)
+		}
+	}
+}
+
+func (c *hostConn) requireImport(path, alias string) (string, error) {
+	c.writeByte(msgImport)
+	c.writeString(path)
+	c.writeString(alias)
+	if err := c.flush(); err != nil {
+		return "", err
+	}
+	if kind := c.readByte(); kind != msgReply && c.err == nil {
+		c.fail(fmt.Errorf("unexpected message %v", kind))
+	}
+	name := c.readString()
+	err := c.readError()
+	if c.err != nil {
+		return "", c.err
+	}
+	return name, err
+}
+
+func (c *hostConn) emitTopLevel(form *list.Pair) error {
+	c.writeByte(msgEmit)
+	if err := c.writeForm(form); err != nil {
+		c.buf.Reset()
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if kind := c.readByte(); kind != msgReply && c.err == nil {
+		c.fail(fmt.Errorf("unexpected message %v", kind))
+	}
+	err := c.readError()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
+
+func (c *hostConn) report(kind byte, form interface{}, msg string) {
+	c.writeByte(kind)
+	c.writeForm(form)
+	c.writeString(msg)
+	c.flush()
+}
+
+func callMacro(fn macro, form *list.Pair, env Environment) (newForm interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			newForm, err = nil, fmt.Errorf("macro panicked: %v", e)
+		}
+	}()
+	return fn(form, env)
+}
+
+// ServePluginHost loads the plugin binary file, and serves requests for
+// invoking its macro functions that it reads from in, writing responses
+// to out, until in is closed. Programs that embed the compiler and set
+// Config.UsePluginHosts must invoke ServePluginHost when they are started with
+// PluginHostFlag and a plugin binary as command-line arguments, with in
+// and out referring to file descriptors 3 and 4 respectively.
+func ServePluginHost(file string, in *os.File, out *os.File) error {
+	c := newHostConn(in, out)
+	p, err := openInProcess(file)
+	if err == nil && os.Getenv(isolatedHostEnv) != "" {
+		err = enterIsolation()
+	}
+	c.writeByte(msgReady)
+	c.writeError(err)
+	if err != nil {
+		c.flush()
+		return err
+	}
+	if _, ok, _ := p.lookupReaderMacros(); ok {
+		c.writeByte(1)
+	} else {
+		c.writeByte(0)
+	}
+	c.writeManifest(p.lookupManifest())
+	if err := c.flush(); err != nil {
+		return err
+	}
+	for {
+		kind := c.readByte()
+		if c.err == io.EOF {
+			return nil
+		} else if c.err != nil {
+			return c.err
+		}
+		switch kind {
+		case msgLookup:
+			name := c.readString()
+			_, err := lookupMacro(p, name)
+			c.writeByte(msgReply)
+			c.writeError(err)
+		case msgCall:
+			c.forms = newFormTable()
+			name := c.readString()
+			counter := c.readVarint()
+			form := c.readForm()
+			if c.err != nil {
+				return c.err
+			}
+			lib.AdvanceGensymCounter(counter)
+			var newForm interface{}
+			fn, err := lookupMacro(p, name)
+			if err == nil {
+				if pair, ok := form.(*list.Pair); ok {
+					newForm, err = callMacro(fn, pair, Environment{host: c})
+				} else {
+					err = errors.New("macro invocation form is not a list")
+				}
+			}
+			c.writeByte(msgResult)
+			c.writeVarint(lib.GensymCounter())
+			if werr := c.writeForm(newForm); werr != nil && err == nil {
+				err = werr
+			}
+			c.writeError(err)
+		default:
+			return fmt.Errorf("unexpected message %v", kind)
+		}
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+}
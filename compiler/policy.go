@@ -0,0 +1,137 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pcostanza/slick/list"
+)
+
+// MacroPolicy limits the execution of macro functions, so that a buggy
+// macro cannot hang or hijack the compiler.
+type MacroPolicy struct {
+	// Timeout limits the duration of a single macro expansion. If zero,
+	// macro expansions are not limited in time. A macro function that
+	// runs in the compiler process and exceeds the timeout is abandoned,
+	// but cannot be stopped: Its goroutine keeps running, and holds on to
+	// its memory, until the macro function returns, if ever. A plugin
+	// host process is stopped instead, so long-running processes that
+	// expect runaway macros should use plugin hosts.
+	Timeout time.Duration
+
+	// MaxExpansions limits the number of macro expansions within a single
+	// top-level declaration, which catches macros that expand into
+	// invocations of themselves indefinitely. If zero, the limit is
+	// DefaultMaxExpansions. If negative, the number of macro expansions
+	// is not limited.
+	MaxExpansions int
+
+	// Isolated prohibits macro functions from accessing the filesystem
+	// and the network. This implies that plugins are loaded into plugin
+	// host processes, and is currently only supported on Linux.
+	Isolated bool
+}
+
+// DefaultMaxExpansions is the limit of macro expansions within a single
+// top-level declaration if MacroPolicy.MaxExpansions is zero.
+const DefaultMaxExpansions = 10000
+
+var errAbandoned = errors.New("macro expansion has been abandoned")
+
+// An expansion guards the environment of a macro function that runs in a
+// separate goroutine. Once it is abandoned, calls of Environment methods
+// have no effect anymore, so that they do not interfere with the compiler.
+type expansion struct {
+	sync.Mutex
+	abandoned bool
+}
+
+func (env Environment) enter() bool {
+	if env.exp == nil {
+		return true
+	}
+	env.exp.Lock()
+	if env.exp.abandoned {
+		env.exp.Unlock()
+		return false
+	}
+	return true
+}
+
+func (env Environment) leave() {
+	if env.exp != nil {
+		env.exp.Unlock()
+	}
+}
+
+func describeForm(form interface{}) string {
+	const max = 60
+	s := fmt.Sprint(form)
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
+
+func timeoutError(name string, timeout time.Duration, form *list.Pair) error {
+	return fmt.Errorf("macro %v timed out after %v while expanding %v", name, timeout, describeForm(form))
+}
+
+// withTimeout wraps fn, so that it runs in a separate goroutine that is
+// abandoned when it exceeds the timeout of the macro policy. Panics are
+// propagated to the goroutine that invokes the macro function. Go offers
+// no way to stop the goroutine of an abandoned expansion, which therefore
+// leaks until fn returns. Its result is dropped, since done is buffered.
+func withTimeout(name string, fn macro) macro {
+	return func(form *list.Pair, env Environment) (interface{}, error) {
+		timeout := env.cmp.config.Macros.Timeout
+		if timeout <= 0 {
+			return fn(form, env)
+		}
+		type result struct {
+			newForm  interface{}
+			err      error
+			panicked interface{}
+		}
+		env.exp = &expansion{}
+		done := make(chan result, 1)
+		go func() {
+			defer func() {
+				if e := recover(); e != nil {
+					done <- result{panicked: e}
+				}
+			}()
+			newForm, err := fn(form, env)
+			done <- result{newForm: newForm, err: err}
+		}()
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case r := <-done:
+			if r.panicked != nil {
+				panic(r.panicked)
+			}
+			return r.newForm, r.err
+		case <-timer.C:
+			env.exp.Lock()
+			env.exp.abandoned = true
+			env.exp.Unlock()
+			return nil, timeoutError(name, timeout, form)
+		}
+	}
+}
+
+func (cmp *compiler) checkExpansions(name string, form *list.Pair) error {
+	cmp.expansions++
+	max := cmp.config.Macros.MaxExpansions
+	if max == 0 {
+		max = DefaultMaxExpansions
+	}
+	if max > 0 && cmp.expansions > max {
+		return fmt.Errorf("more than %v macro expansions in a single top-level declaration, last by macro %v while expanding %v",
+			max, name, describeForm(form))
+	}
+	return nil
+}
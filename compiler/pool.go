@@ -0,0 +1,86 @@
+package compiler
+
+import (
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+Quoted lists are constant, so the compiler hoists their construction
+into package-level variables that are initialized once, instead of
+allocating them anew each time the quote form is evaluated. The
+variable declarations are appended to the end of the compiled file.
+
+When quoted lists are interned, this includes the constant parts of
+quasiquote templates, which the compiler quotes itself. A constant part
+is then only expanded once per file, no matter how many templates
+contain it, which speeds up the compilation of template-heavy macro
+packages. The lists constructed from templates use their constant parts
+as tails, so destructive operations on one of them, like SetCdr or
+NReverse, affect all templates with structurally identical constant
+parts.
+*/
+
+type quotedPool struct {
+	decls     []byte
+	interned  map[digest]*lib.Symbol
+	templates map[*list.Pair]digest
+	active    bool
+}
+
+// addTemplate records that the quote form q quotes a constant part of a
+// quasiquote template.
+func (cmp *compiler) addTemplate(q *list.Pair) {
+	key, ok := hashForm(list.Cadr(q))
+	if !ok {
+		return
+	}
+	if cmp.pool.templates == nil {
+		cmp.pool.templates = make(map[*list.Pair]digest)
+	}
+	cmp.pool.templates[q] = key
+}
+
+// pooledTemplate returns the variable of a constant part of a quasiquote
+// template that is structurally identical to the one quoted by q, if q
+// quotes a constant part of a quasiquote template as well.
+func (cmp *compiler) pooledTemplate(q *list.Pair) (*lib.Symbol, bool) {
+	key, ok := cmp.pool.templates[q]
+	if !ok || cmp.pool.active {
+		return nil, false
+	}
+	name, ok := cmp.pool.interned[key]
+	if ok {
+		delete(cmp.pool.templates, q)
+	}
+	return name, ok
+}
+
+// poolQuoted returns the name of a package-level variable that is
+// initialized with expansion, the result of the quote form q of datum.
+func (cmp *compiler) poolQuoted(form, q *list.Pair, datum *list.Pair, expansion interface{}) *lib.Symbol {
+	key, intern := cmp.pool.templates[q]
+	if intern {
+		delete(cmp.pool.templates, q)
+	} else if cmp.config.InternQuotedLists {
+		key, intern = hashForm(datum)
+		if name, ok := cmp.pool.interned[key]; intern && ok {
+			return name
+		}
+	}
+	name := lib.Gensym("quoted")
+	cmp.pool.active = true
+	decls := append(cmp.pool.decls, "var "...)
+	decls = append(decls, name.Identifier...)
+	decls = append(decls, " = "...)
+	decls = cmp.compileExpression(decls, form, expansion)
+	cmp.pool.decls = append(decls, '\n', '\n')
+	cmp.pool.active = false
+	if intern {
+		if cmp.pool.interned == nil {
+			cmp.pool.interned = make(map[digest]*lib.Symbol)
+		}
+		cmp.pool.interned[key] = name
+	}
+	return name
+}
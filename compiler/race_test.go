@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package compiler_test
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,186 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+/*
+The compiler handles quasiquotation natively, so that misplaced or
+malformed unquote and unquote-splicing forms are reported at their own
+source positions. A quasiquoted datum is translated into calls of
+list.Cons and list.Append, and the constant parts of the datum are
+translated into quote forms, which are expanded by the lib plugin.
+When Config.InternQuotedLists is set, structurally identical constant parts
+within a file are expanded only once, and share their package-level
+variable.
+*/
+
+var (
+	_listCons   = lib.Intern("github.com/pcostanza/slick/list", "Cons")
+	_listAppend = lib.Intern("github.com/pcostanza/slick/list", "Append")
+)
+
+// spliceBody returns the forms enclosed by a splice form, or reports
+// an error if they do not form a proper list.
+func (cmp *compiler) spliceBody(form *list.Pair) (*list.Pair, bool) {
+	if !list.IsProper(form.Cdr) {
+		cmp.error(form, fmt.Sprintf("invalid splice form %v", form))
+		return nil, false
+	}
+	return form.Cdr.(*list.Pair), true
+}
+
+// expandMacros expands element for as long as it is a macro invocation.
+func (cmp *compiler) expandMacros(form *list.Pair, element interface{}) (interface{}, bool) {
+	for {
+		e, ok := element.(*list.Pair)
+		if !ok || e == nil {
+			return element, true
+		}
+		sym, ok := e.Car.(*lib.Symbol)
+		if !ok || len(sym.Package) == 0 || sym.Package[0] != '#' {
+			return element, true
+		}
+		if element, ok = cmp.expandMacro(form, e, sym); !ok {
+			return nil, false
+		}
+	}
+}
+
+// spliceExpressions replaces the splice forms among elements by the
+// expressions they enclose, including splice forms that are the result
+// of macro invocations. Elements whose macroexpansion fails are dropped.
+func (cmp *compiler) spliceExpressions(form *list.Pair, elements []interface{}) []interface{} {
+	result := make([]interface{}, 0, len(elements))
+	for _, element := range elements {
+		element, ok := cmp.expandMacros(form, element)
+		if !ok {
+			continue
+		}
+		if e, ok := element.(*list.Pair); ok && e != nil && e.Car == _splice {
+			if body, ok := cmp.spliceBody(e); ok {
+				result = append(result, cmp.spliceExpressions(e, body.ToSlice())...)
+			}
+			continue
+		}
+		result = append(result, element)
+	}
+	return result
+}
+
+// checkQuasiquote reports an error unless form has exactly one argument.
+func (cmp *compiler) checkQuasiquote(form *list.Pair) bool {
+	if rest, ok := form.Cdr.(*list.Pair); !ok || rest == nil || rest.Cdr != list.Nil() {
+		cmp.error(form, fmt.Sprintf("%v form must have exactly one argument: %v", form.Car, form))
+		return false
+	}
+	return true
+}
+
+// expandQuasiquote translates the quasiquote form into an expression
+// that constructs the quasiquoted datum.
+func (cmp *compiler) expandQuasiquote(form *list.Pair) interface{} {
+	if !cmp.checkQuasiquote(form) {
+		return list.Nil()
+	}
+	return cmp.quasiquoted(cmp.quasiquote(list.Cadr(form), 0))
+}
+
+// quasiquoted returns expr, or a quote form of expr if it is constant.
+func (cmp *compiler) quasiquoted(expr interface{}, constant bool) interface{} {
+	if constant {
+		q := list.List(_quote, expr)
+		if datum, ok := expr.(*list.Pair); ok && datum != nil && cmp.config.InternQuotedLists {
+			cmp.addTemplate(q)
+		}
+		return q
+	}
+	return expr
+}
+
+// quasiquote returns the translation of x at the given nesting level of
+// quasiquote forms, and whether x is constant. For constant data, the
+// translation is x itself.
+func (cmp *compiler) quasiquote(x interface{}, level int) (interface{}, bool) {
+	form, ok := x.(*list.Pair)
+	if !ok || form == nil {
+		return x, true
+	}
+	switch form.Car {
+	case _quasiquote:
+		if !cmp.checkQuasiquote(form) {
+			return x, true
+		}
+		return cmp.quasiquotePair(form, level+1)
+	case _unquote:
+		if !cmp.checkQuasiquote(form) {
+			return x, true
+		}
+		if level == 0 {
+			return list.Cadr(form), false
+		}
+		return cmp.quasiquotePair(form, level-1)
+	case _unquote_splicing:
+		if !cmp.checkQuasiquote(form) {
+			return x, true
+		}
+		if level == 0 {
+			cmp.error(form, "unquote-splicing must be an element of a quasiquoted list")
+			return x, true
+		}
+		return cmp.quasiquotePair(form, level-1)
+	}
+	return cmp.quasiquotePair(form, level)
+}
+
+func (cmp *compiler) quasiquotePair(form *list.Pair, level int) (interface{}, bool) {
+	if car, ok := form.Car.(*list.Pair); ok && car != nil && car.Car == _unquote_splicing && level == 0 {
+		if !cmp.checkQuasiquote(car) {
+			return form, true
+		}
+		spliced := list.Cadr(car)
+		if !cmp.checkSpliced(car, spliced) {
+			return form, true
+		}
+		if _, ok := form.Cdr.(*list.Pair); !ok {
+			cmp.error(car, fmt.Sprintf("unquote-splicing in a dotted list: %v", form))
+			return form, true
+		}
+		rest, constant := cmp.quasiquote(form.Cdr, level)
+		if constant && rest == list.Nil() {
+			return spliced, false
+		}
+		return list.List(_listAppend, spliced, cmp.quasiquoted(rest, constant)), false
+	}
+	car, carConstant := cmp.quasiquote(form.Car, level)
+	cdr, cdrConstant := cmp.quasiquote(form.Cdr, level)
+	if carConstant && cdrConstant {
+		return form, true
+	}
+	return list.List(_listCons, cmp.quasiquoted(car, carConstant), cmp.quasiquoted(cdr, cdrConstant)), false
+}
+
+// checkSpliced reports an error if the expression of an unquote-splicing
+// form is a literal that is not a list, such as a number, a string, a
+// keyword, or a quoted symbol.
+func (cmp *compiler) checkSpliced(form *list.Pair, spliced interface{}) bool {
+	datum := spliced
+	if q, ok := spliced.(*list.Pair); ok && q != nil && q.Car == _quote {
+		datum = list.Cadr(q)
+	} else if ok {
+		return true
+	}
+	switch datum.(type) {
+	case *list.Pair:
+		return true
+	case *lib.Symbol:
+		if datum == spliced && datum.(*lib.Symbol).Package != "_keyword" {
+			return true
+		}
+	}
+	cmp.error(form, fmt.Sprintf("unquote-splicing of a non-list: %v", form))
+	return false
+}
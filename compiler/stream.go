@@ -0,0 +1,84 @@
+package compiler
+
+import (
+	"io"
+	"os"
+)
+
+/*
+When streaming, the compiler writes compiled top-level declarations to
+a temporary file in chunks, instead of keeping them in memory until the
+end of the source file, and forgets the source positions of the forms
+it has compiled. The import declaration is only known at the end, so
+the output is written when the whole file has been compiled: first the
+header with the imports, then the chunks from the temporary file. The
+declarations of quoted lists are written with the chunk that contains
+their first use, instead of at the end of the file.
+*/
+
+// streamChunk is the size from which the compiled declarations are
+// written to the temporary file.
+const streamChunk = 64 << 10
+
+// A declStream is the temporary file of a streaming compilation.
+type declStream struct {
+	file   *os.File
+	chunks []int // sizes of the chunks, which end at declaration boundaries
+}
+
+func (s *declStream) write(chunk []byte) error {
+	if s.file == nil {
+		file, err := os.CreateTemp("", "slick-*.go")
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	if _, err := s.file.Write(chunk); err != nil {
+		return err
+	}
+	s.chunks = append(s.chunks, len(chunk))
+	return nil
+}
+
+// copyTo passes the chunks to write, one by one and in order.
+func (s *declStream) copyTo(write func([]byte) error) error {
+	if s.file == nil {
+		return nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, n := range s.chunks {
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		if _, err := io.ReadFull(s.file, buf[:n]); err != nil {
+			return err
+		}
+		if err := write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *declStream) close() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// flush writes the compiled declarations and the declarations of quoted
+// lists to the stream, once they exceed the chunk size.
+func (cmp *compiler) flush(stream *declStream, result []byte) ([]byte, error) {
+	if len(result)+len(cmp.pool.decls) < streamChunk {
+		return result, nil
+	}
+	result = append(result, cmp.pool.decls...)
+	cmp.pool.decls = cmp.pool.decls[:0]
+	cmp.reader.ForgetPositions()
+	return result[:0], stream.write(result)
+}
@@ -0,0 +1,145 @@
+// Package main provides macros for testing the macro machinery of the
+// compiler. It is used as the plugin with import path example.com/macros.
+package main
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/pcostanza/slick/compiler"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+var quote = lib.Intern("", "quote")
+
+// Echo quotes its arguments, followed by values that the reader does not
+// produce, and a list that shares structure with the arguments. Like Pid,
+// it is not cached, so that it always runs in a plugin host if there is
+// one.
+func Echo(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	lib.Gensym("echo")
+	args := form.Cdr.(*list.Pair)
+	extra := list.List(complex(1, -2), 42, 1.5, true, list.Cons("a", "b"), args)
+	return list.List(quote, list.Cons(args, extra)), nil
+}
+
+// Pid expands into the process ID of the process that runs the macro. It
+// generates a fresh symbol, so that its expansions are not cached.
+func Pid(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	lib.Gensym("pid")
+	return big.NewInt(int64(os.Getpid())), nil
+}
+
+// Fail fails with the message given as its argument.
+func Fail(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	msg, _ := list.Cadr(form).(string)
+	return nil, errors.New(msg)
+}
+
+// Count expands into an invocation of itself with its argument decremented
+// by one, and into 0 once its argument is 0.
+func Count(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	n, ok := list.Cadr(form).(*big.Int)
+	if !ok {
+		return nil, errors.New("Count expects an integer")
+	}
+	if n.Sign() <= 0 {
+		return big.NewInt(0), nil
+	}
+	return list.List(form.Car, new(big.Int).Sub(n, big.NewInt(1))), nil
+}
+
+// Sleep sleeps for the number of milliseconds given as its argument, and
+// expands into 0.
+func Sleep(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	n, _ := list.Cadr(form).(*big.Int)
+	time.Sleep(time.Duration(n.Int64()) * time.Millisecond)
+	return big.NewInt(0), nil
+}
+
+// ReadFile expands into the contents of the file given as its argument.
+func ReadFile(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	lib.Gensym("file")
+	name, _ := list.Cadr(form).(string)
+	data, err := os.ReadFile(name)
+	return string(data), err
+}
+
+// Helper requires an import of the package given as its argument, emits
+// an auxiliary variable declaration, and expands into a reference to it.
+func Helper(form *list.Pair, env compiler.Environment) (interface{}, error) {
+	path, _ := list.Cadr(form).(string)
+	if _, err := env.RequireImport(path, "_"); err != nil {
+		return nil, err
+	}
+	helper := lib.Intern("", "helper")
+	if err := env.EmitTopLevel(list.List(lib.Intern("", "var"), list.List(helper, lib.Intern("_keyword", "="), big.NewInt(42)))); err != nil {
+		return nil, err
+	}
+	return helper, nil
+}
+
+// Report reports a warning at its first argument and an error at its
+// second argument.
+func Report(form *list.Pair, env compiler.Environment) (interface{}, error) {
+	env.Warnf(list.Cadr(form), "warned on purpose")
+	env.Errorf(list.Caddr(form), "failed on purpose")
+	return big.NewInt(0), nil
+}
+
+var dot = lib.Intern("", ".")
+
+// Dotted expands into its argument, in which each list whose second to
+// last element is the symbol . is turned into a dotted list, since the
+// reader has no syntax for dotted lists.
+func Dotted(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	return dotted(list.Cadr(form)), nil
+}
+
+func dotted(x interface{}) interface{} {
+	l, ok := x.(*list.Pair)
+	if !ok || l == nil || !list.IsProper(l) {
+		return x
+	}
+	elements := l.ToSlice()
+	for i, element := range elements {
+		elements[i] = dotted(element)
+	}
+	n := len(elements)
+	if n < 3 || elements[n-2] != dot {
+		return list.List(elements...)
+	}
+	elements = append(elements[:n-2], elements[n-1])
+	return list.Cons(elements[0], elements[1], elements[2:]...)
+}
+
+var calls int64
+
+// Calls expands into the number of times it has been called so far.
+func Calls(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	calls++
+	return big.NewInt(calls), nil
+}
+
+// Fresh is like Calls, but generates a fresh symbol, so that its
+// expansions are not cached.
+func Fresh(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	lib.Gensym("fresh")
+	calls++
+	return big.NewInt(calls), nil
+}
+
+// Imported is like Calls, but requires an import, so that its expansions
+// are not cached.
+func Imported(form *list.Pair, env compiler.Environment) (interface{}, error) {
+	if _, err := env.RequireImport("strings", ""); err != nil {
+		return nil, err
+	}
+	calls++
+	return big.NewInt(calls), nil
+}
+
+func main() {}
@@ -0,0 +1,49 @@
+// Package main is a stand-in for the core Slick plugin in tests. Its Quote
+// macro expands quote forms into calls of a function quoted with a
+// description of the datum, which is enough to recognize pooled variables,
+// and shows the types of the values in the datum.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pcostanza/slick/compiler"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+)
+
+func Quote(form *list.Pair, _ compiler.Environment) (interface{}, error) {
+	var b strings.Builder
+	describe(&b, list.Cadr(form))
+	return list.List(lib.Intern("", "quoted"), b.String()), nil
+}
+
+// describe prints symbols and lists in reader syntax, and other values
+// with their types.
+func describe(b *strings.Builder, x interface{}) {
+	switch x := x.(type) {
+	case *list.Pair:
+		b.WriteByte('(')
+		for i := 0; x != list.Nil(); i++ {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			describe(b, x.Car)
+			next, ok := x.Cdr.(*list.Pair)
+			if !ok {
+				b.WriteString(" . ")
+				describe(b, x.Cdr)
+				break
+			}
+			x = next
+		}
+		b.WriteByte(')')
+	case *lib.Symbol:
+		b.WriteString(x.String())
+	default:
+		fmt.Fprintf(b, "%T(%v)", x, x)
+	}
+}
+
+func main() {}
@@ -0,0 +1,29 @@
+// Package main provides reader macros for testing their installation by
+// the compiler. It is used as the plugin with import path
+// example.com/bang.
+package main
+
+import (
+	"errors"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+var quote = lib.Intern("", "quote")
+
+// ReaderMacros installs #! as an alternative syntax for quote. It fails
+// if #! is already defined.
+func ReaderMacros(table *reader.Table) error {
+	if table.GetDispatchMacroRune('#', '!') != nil {
+		return errors.New("duplicate reader macro #!")
+	}
+	table.SetDispatchMacroRune('#', '!', func(rd *reader.Reader, _ rune, _ int) interface{} {
+		rd.NextRune()
+		return list.List(quote, rd.Read())
+	})
+	return nil
+}
+
+func main() {}
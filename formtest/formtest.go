@@ -0,0 +1,280 @@
+// Package formtest implements support for testing code that produces
+// Slick forms, such as macro functions and compiler passes.
+//
+// Forms are compared structurally rather than as text, so tests do not
+// depend on the formatting of the forms, or of the Go code that is
+// eventually generated from them. When forms differ, Diff describes each
+// mismatching subtree by its path in the expected form, for example
+// "car of 3rd element of 2nd element". Golden files contain printed
+// forms, which are read back with the Slick reader before they are
+// compared.
+package formtest
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+// Equal reports whether x and y are structurally equal forms. Lists are
+// equal if their elements are equal, integers are equal if they have the
+// same value, and all other values are compared with ==.
+func Equal(x, y interface{}) bool {
+	switch x := x.(type) {
+	case *list.Pair:
+		return list.EqualWith(x, y, Equal)
+	case *big.Int:
+		y, ok := y.(*big.Int)
+		return ok && (x == y || x != nil && y != nil && x.Cmp(y) == 0)
+	default:
+		return x == y
+	}
+}
+
+// Diff returns a description of the differences between the forms want
+// and got, with one line per mismatching subtree, or "" if the forms are
+// equal. Elements of proper lists of the same length are compared one by
+// one, and the cars and cdrs of dotted lists are compared separately.
+func Diff(want, got interface{}) string {
+	var lines []string
+	diff(&lines, nil, want, got)
+	return strings.Join(lines, "\n")
+}
+
+func diff(lines *[]string, path []string, want, got interface{}) {
+	if Equal(want, got) {
+		return
+	}
+	step := func(s string) []string {
+		return append(path[:len(path):len(path)], s)
+	}
+	wantPair, ok1 := want.(*list.Pair)
+	gotPair, ok2 := got.(*list.Pair)
+	if ok1 && ok2 && wantPair != nil && gotPair != nil {
+		if !list.IsProper(wantPair) || !list.IsProper(gotPair) {
+			diff(lines, step("car"), wantPair.Car, gotPair.Car)
+			diff(lines, step("cdr"), wantPair.Cdr, gotPair.Cdr)
+			return
+		}
+		if wantElements, gotElements := wantPair.ToSlice(), gotPair.ToSlice(); len(wantElements) == len(gotElements) {
+			for i := range wantElements {
+				diff(lines, step(Ordinal(i+1)+" element"), wantElements[i], gotElements[i])
+			}
+			return
+		}
+	}
+	*lines = append(*lines, fmt.Sprintf("%v: want %v, got %v", describe(path), Print(want), Print(got)))
+}
+
+// describe returns the path of a subtree, innermost step first.
+func describe(path []string) string {
+	if len(path) == 0 {
+		return "form"
+	}
+	steps := make([]string, len(path))
+	for i, s := range path {
+		steps[len(path)-1-i] = s
+	}
+	return strings.Join(steps, " of ")
+}
+
+// Ordinal returns n as an English ordinal number, like 1st, 2nd, or 3rd.
+func Ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// Print returns form printed in Slick syntax, such that the standard
+// reader reads it back as an equal form, provided the packages of its
+// symbols can be resolved. Dotted lists are printed with a dot before
+// their tail, but cannot be read back. Likewise, complex numbers with a
+// non-zero real part, which have no literal syntax, are printed as in Go,
+// for example (1+2i), which reads back as a list.
+func Print(form interface{}) string {
+	return string(appendForm(nil, form))
+}
+
+func appendForm(buf []byte, form interface{}) []byte {
+	switch f := form.(type) {
+	case *list.Pair:
+		if f == nil {
+			return append(buf, "()"...)
+		}
+		buf = append(buf, '(')
+		buf = appendForm(buf, f.Car)
+		for {
+			next, ok := f.Cdr.(*list.Pair)
+			if !ok {
+				buf = append(buf, " . "...)
+				buf = appendForm(buf, f.Cdr)
+				break
+			}
+			if next == nil {
+				break
+			}
+			buf = append(buf, ' ')
+			buf = appendForm(buf, next.Car)
+			f = next
+		}
+		return append(buf, ')')
+	case *lib.Symbol:
+		return append(buf, f.String()...)
+	case string:
+		return strconv.AppendQuote(buf, f)
+	case rune:
+		return appendRune(buf, f)
+	case *big.Int:
+		return f.Append(buf, 10)
+	case float64:
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnN") {
+			s += ".0"
+		}
+		return append(buf, s...)
+	case complex128:
+		if real(f) == 0 {
+			buf = strconv.AppendFloat(buf, imag(f), 'g', -1, 64)
+			return append(buf, 'i')
+		}
+	}
+	return append(buf, fmt.Sprint(form)...)
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	buf = append(buf, '#', '\\')
+	switch r {
+	case '\a':
+		return append(buf, "\\a"...)
+	case '\b':
+		return append(buf, "\\b"...)
+	case '\f':
+		return append(buf, "\\f"...)
+	case '\n':
+		return append(buf, "\\n"...)
+	case '\r':
+		return append(buf, "\\r"...)
+	case ' ':
+		return append(buf, "\\s"...)
+	case '\t':
+		return append(buf, "\\t"...)
+	case '\v':
+		return append(buf, "\\v"...)
+	case '\\':
+		return append(buf, "\\\\"...)
+	}
+	switch {
+	case unicode.IsPrint(r):
+		return append(buf, string(r)...)
+	case r < 0x10000:
+		return append(buf, fmt.Sprintf("\\u%04x", r)...)
+	default:
+		return append(buf, fmt.Sprintf("\\U%08x", r)...)
+	}
+}
+
+// packages adds the packages of the symbols in form to resolver, so that
+// printed symbols can be read back.
+func packages(resolver *reader.PackageResolver, form interface{}) {
+	switch f := form.(type) {
+	case *list.Pair:
+		for ; f != nil; f, _ = f.Cdr.(*list.Pair) {
+			packages(resolver, f.Car)
+			if _, ok := f.Cdr.(*list.Pair); !ok {
+				packages(resolver, f.Cdr)
+			}
+		}
+	case *lib.Symbol:
+		if f.Package != "" && f.Package != "_keyword" {
+			resolver.PackageToPath[f.Package] = f.Package
+		}
+	}
+}
+
+// ReadGolden reads the forms in a golden file. Symbols are resolved with
+// the packages of the symbols in forms, which are the forms the golden
+// file is compared with.
+func ReadGolden(file string, forms ...interface{}) ([]interface{}, error) {
+	rd, err := reader.NewReader(nil, file, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	rd.SetRecordPositions(false)
+	for _, form := range forms {
+		packages(rd.PackageResolver, form)
+	}
+	var result []interface{}
+	for {
+		n := rd.Errors.Len()
+		form := rd.Read()
+		if form == io.EOF {
+			break
+		}
+		if bad, ok := form.(*reader.BadForm); ok {
+			if rd.Errors.Len() == n {
+				from, to := rd.File().Offset(bad.Pos()), rd.File().Offset(bad.End())
+				rd.Errors.Add(rd.File().Position(bad.Pos()), fmt.Sprintf("invalid form %s", rd.Bytes()[from:to]))
+			}
+			continue
+		}
+		result = append(result, form)
+	}
+	if err := rd.Errors.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WriteGolden writes forms to a golden file, one per line.
+func WriteGolden(file string, forms ...interface{}) error {
+	var buf []byte
+	for _, form := range forms {
+		buf = appendForm(buf, form)
+		buf = append(buf, '\n')
+	}
+	return os.WriteFile(file, buf, 0644)
+}
+
+// Golden compares forms with the forms in a golden file, and reports the
+// differences as test errors. If update is true, the golden file is
+// rewritten with forms first. Tests typically pass the value of an
+// -update flag.
+func Golden(t testing.TB, file string, update bool, forms ...interface{}) {
+	t.Helper()
+	if update {
+		if err := WriteGolden(file, forms...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ReadGolden(file, forms...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != len(forms) {
+		t.Errorf("%v: want %v forms, got %v", file, len(want), len(forms))
+	}
+	for i := 0; i < len(want) && i < len(forms); i++ {
+		if d := Diff(want[i], forms[i]); d != "" {
+			t.Errorf("%v: %v form differs:\n%v", file, Ordinal(i+1), d)
+		}
+	}
+}
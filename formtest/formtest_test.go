@@ -0,0 +1,108 @@
+package formtest_test
+
+import (
+	"flag"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/pcostanza/slick/formtest"
+	"github.com/pcostanza/slick/lib"
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func read(t *testing.T, src string) interface{} {
+	t.Helper()
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.PackageToPath["fmt"] = "fmt"
+	form := rd.Read()
+	if err := rd.Errors.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return form
+}
+
+func TestEqual(t *testing.T) {
+	if !formtest.Equal(read(t, "(a (b 42 . c) \"d\")"), read(t, "(a\n  (b 42 . c)\n  \"d\")")) {
+		t.Error("equal forms reported as different")
+	}
+	if formtest.Equal(read(t, "(a (b 42))"), read(t, "(a (b 43))")) {
+		t.Error("different forms reported as equal")
+	}
+	if !formtest.Equal(big.NewInt(1), big.NewInt(1)) || formtest.Equal(big.NewInt(1), 1) {
+		t.Error("integers compared incorrectly")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct{ want, got, diff string }{
+		{"(a b)", "(a b)", ""},
+		{"(a b)", "(a c)", "2nd element: want b, got c"},
+		{"(a (b c (d e)))", "(a (b c (x e)))", "1st element of 3rd element of 2nd element: want d, got x"},
+		{"(a (b) c)", "(a (b d) e)", "2nd element: want (b), got (b d)\n3rd element: want c, got e"},
+		{"(a \"b\")", "(a #\\b)", `2nd element: want "b", got #\b`},
+	} {
+		if diff := formtest.Diff(read(t, test.want), read(t, test.got)); diff != test.diff {
+			t.Errorf("unexpected diff for %v and %v:\n%v", test.want, test.got, diff)
+		}
+	}
+}
+
+func TestDottedLists(t *testing.T) {
+	a, b, c, d := lib.Intern("", "a"), lib.Intern("", "b"), lib.Intern("", "c"), lib.Intern("", "d")
+	want := list.List(a, list.Cons(b, c, d))
+	got := list.List(a, list.Cons(b, a, a))
+	if diff := formtest.Diff(want, got); diff != "car of cdr of 2nd element: want c, got a\ncdr of cdr of 2nd element: want d, got a" {
+		t.Errorf("unexpected diff:\n%v", diff)
+	}
+	if diff := formtest.Diff(list.List(a), b); diff != "form: want (a), got b" {
+		t.Errorf("unexpected diff:\n%v", diff)
+	}
+	if diff := formtest.Diff(list.List(a, b), list.Cons(a, c)); diff != "cdr: want (b), got c" {
+		t.Errorf("unexpected diff:\n%v", diff)
+	}
+	if diff := formtest.Diff(list.List(a, list.List(b)), list.List(a, b)); diff != "2nd element: want (b), got b" {
+		t.Errorf("unexpected diff:\n%v", diff)
+	}
+	if printed := formtest.Print(got); printed != "(a (b a . a))" {
+		t.Errorf("unexpected print %v", printed)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	for _, src := range []string{
+		`(fmt:Println "a\tb\"" #\a #\\s #\\n #\\\ :key (1 2.5) 3i 1.0 ())`,
+		"(quote x)",
+	} {
+		form := read(t, src)
+		if printed := formtest.Print(form); printed != src {
+			t.Errorf("%v printed as %v", src, printed)
+		}
+	}
+	if printed := formtest.Print(list.List(complex(1, 2), complex(0, -2.5))); printed != "((1+2i) -2.5i)" {
+		t.Errorf("complex numbers printed as %v", printed)
+	}
+}
+
+func TestOrdinal(t *testing.T) {
+	for n, s := range map[int]string{1: "1st", 2: "2nd", 3: "3rd", 4: "4th", 11: "11th", 12: "12th", 13: "13th", 21: "21st", 102: "102nd"} {
+		if formtest.Ordinal(n) != s {
+			t.Errorf("Ordinal(%v) = %v", n, formtest.Ordinal(n))
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	forms := []interface{}{
+		list.List(lib.Intern("", "func"), lib.Intern("", "f"), list.Nil(), list.Nil(),
+			list.List(lib.Intern("github.com/pcostanza/slick/list", "Cons"), big.NewInt(1), "two", '3')),
+		lib.Intern("_keyword", "done"),
+	}
+	formtest.Golden(t, filepath.Join("testdata", "forms.golden"), *update, forms...)
+}
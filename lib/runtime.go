@@ -41,3 +41,16 @@ func Gensym(prefix string) *Symbol {
 	}
 	return Intern("", fmt.Sprintf("_%v%v", prefix, ncounter))
 }
+
+func GensymCounter() int64 {
+	return atomic.LoadInt64(&gensymCounter)
+}
+
+func AdvanceGensymCounter(counter int64) {
+	for {
+		old := atomic.LoadInt64(&gensymCounter)
+		if old >= counter || atomic.CompareAndSwapInt64(&gensymCounter, old, counter) {
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package list
+
+// An Env is a chain of frames of bindings, as used by macros that
+// implement binding forms. Each frame is an association list, and Outer
+// is the enclosing environment, or nil for the outermost frame. The zero
+// value of Env is an environment with a single empty frame.
+//
+//   env := new(Env)
+//   env.DefineInFrame("x", 1)
+//   inner := env.PushFrame()
+//   inner.DefineInFrame("y", 2)
+//   inner.Lookup("x")        => 1, true
+//   inner.PopFrame() == env  => true
+//   env.Lookup("y")          => nil, false
+//
+type Env struct {
+	Frame *Pair
+	Outer *Env
+}
+
+// PushFrame returns a new environment with an empty innermost frame
+// whose enclosing environment is env.
+func (env *Env) PushFrame() *Env {
+	return &Env{Frame: Nil(), Outer: env}
+}
+
+// PopFrame returns the enclosing environment of env.
+func (env *Env) PopFrame() *Env {
+	return env.Outer
+}
+
+// Lookup finds the binding for key, starting in the innermost frame of env and
+// walking outward through the enclosing environments, and returns its value and true.
+// If there is no binding for key, then nil and false are returned. Lookup uses ==
+// for comparing keys.
+func (env *Env) Lookup(key interface{}) (value interface{}, ok bool) {
+	for e := env; e != nil; e = e.Outer {
+		if pair, ok := e.Frame.Assoc(key); ok {
+			return pair.(*Pair).Cdr, true
+		}
+	}
+	return nil, false
+}
+
+// DefineInFrame binds key to value in the innermost frame of env. If the
+// innermost frame already has a binding for key, then it is updated; bindings in
+// enclosing environments are shadowed, but not changed.
+func (env *Env) DefineInFrame(key, value interface{}) {
+	if pair, ok := env.Frame.Assoc(key); ok {
+		pair.(*Pair).Cdr = value
+		return
+	}
+	env.Frame = env.Frame.ACons(key, value)
+}
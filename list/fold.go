@@ -51,6 +51,28 @@ func (list *Pair) Fold(f func(intermediate, element interface{}) interface{}, in
 	return
 }
 
+// FoldWithIndex is like Fold, but f additionally receives the index of
+// each element in list, starting from 0.
+//
+//   // Sum of the elements at even positions:
+//   list.FoldWithIndex(func(sum, x interface{}, i int) interface{} {
+//     if i%2 == 0 {
+//       return sum.(int) + x.(int)
+//     }
+//     return sum
+//   }, 0)
+//
+// The list argument must be finite.
+func (list *Pair) FoldWithIndex(f func(intermediate, element interface{}, index int) interface{}, init interface{}) (result interface{}) {
+	result = init
+	index := 0
+	for pair := list; pair != nil; pair = pair.Cdr.(*Pair) {
+		result = f(result, pair.Car, index)
+		index++
+	}
+	return
+}
+
 // Fold is the fundamental list iterator.
 //
 // If n list arguments are provided, then the f
@@ -438,6 +460,29 @@ func (list *Pair) Map(f func(element interface{}) interface{}) (result *Pair) {
 	return
 }
 
+// MapWithIndex is like Map, but f additionally receives the index of
+// each element in list, starting from 0.
+// MapWithIndex is guaranteed to call f on the elements of the list in order from left to right.
+//
+//   List("a", "b", "c").MapWithIndex(func(x interface{}, i int) interface{} {
+//     return x.(string) + strconv.Itoa(i)
+//   })                  => ("a0" "b1" "c2")
+//
+func (list *Pair) MapWithIndex(f func(element interface{}, index int) interface{}) (result *Pair) {
+	if list == nil {
+		return
+	}
+	result = &Pair{Car: f(list.Car, 0)}
+	last := result
+	index := 1
+	for pair := list.Cdr.(*Pair); pair != nil; pair = pair.Cdr.(*Pair) {
+		last = last.ncdr(f(pair.Car, index))
+		index++
+	}
+	last.Cdr = (*Pair)(nil)
+	return
+}
+
 // Map applies f element-wise to the elements of the lists and returns a list of the results, in order.
 // f is a function taking as many arguments as there are list arguments and returning a single value.
 // Map is guaranteed to call f on the elements of the lists in order from left to right.
@@ -1,6 +1,7 @@
 package list_test
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/pcostanza/slick/list"
@@ -209,6 +210,35 @@ func TestPredicates(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("EqualWith", func(t *testing.T) {
+		var deep func(x, y interface{}) bool
+		deep = func(x, y interface{}) bool {
+			if list.IsPair(x) {
+				return list.EqualWith(x, y, deep)
+			}
+			return x == y
+		}
+		if !list.EqualWith(list.List(1, list.List(2, 3), list.Cons(4, 5)), list.List(1, list.List(2, 3), list.Cons(4, 5)), deep) {
+			t.Fail()
+		}
+		if list.EqualWith(list.List(1, list.List(2, 3)), list.List(1, list.List(2, 4)), deep) {
+			t.Fail()
+		}
+		if list.EqualWith(list.List(1, 2), list.List(1, 2, 3), deep) {
+			t.Fail()
+		}
+		if list.EqualWith(list.List(1), 1, deep) || list.EqualWith(1, list.List(1), deep) {
+			t.Fail()
+		}
+		if list.EqualWith(list.List(1, 2), list.Cons(1, 2), deep) {
+			t.Fail()
+		}
+		if !list.EqualWith(list.List(1, 2), list.List(1.0, 2.0), func(x, y interface{}) bool {
+			return float64(x.(int)) == y.(float64)
+		}) {
+			t.Fail()
+		}
+	})
 }
 
 func TestSelectors(t *testing.T) {
@@ -550,6 +580,19 @@ func TestFold(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("FoldWithIndex", func(t *testing.T) {
+		if list.List(1, 2, 3, 4, 5).FoldWithIndex(func(sum, x interface{}, i int) interface{} {
+			if i%2 == 0 {
+				return sum.(int) + x.(int)
+			}
+			return sum
+		}, 0) != 9 {
+			t.Fail()
+		}
+		if list.Nil().FoldWithIndex(func(_, _ interface{}, _ int) interface{} { return 1 }, 0) != 0 {
+			t.Fail()
+		}
+	})
 	t.Run("FoldRight", func(t *testing.T) {
 		if !list.Equal(list.List(1, 2, 3, 4, 5).FoldRight(func(t, x interface{}) interface{} { return list.Cons(x, t) }, list.Nil()), list.List(1, 2, 3, 4, 5)) {
 			t.Fail()
@@ -663,6 +706,14 @@ func TestFold(t *testing.T) {
 			t.Fail()
 		}
 	})
+	t.Run("MapWithIndex", func(t *testing.T) {
+		if !list.Equal(list.List("a", "b", "c").MapWithIndex(func(x interface{}, i int) interface{} { return x.(string) + strconv.Itoa(i) }), list.List("a0", "b1", "c2")) {
+			t.Fail()
+		}
+		if list.Nil().MapWithIndex(func(x interface{}, _ int) interface{} { return x }) != list.Nil() {
+			t.Fail()
+		}
+	})
 	t.Run("ForEach", func(t *testing.T) {
 		var v [5]int
 		list.List(0, 1, 2, 3, 4).ForEach(func(x interface{}) {
@@ -924,6 +975,33 @@ func TestAssociationLists(t *testing.T) {
 	})
 }
 
+func TestEnv(t *testing.T) {
+	env := new(list.Env)
+	env.DefineInFrame("x", 1)
+	inner := env.PushFrame()
+	inner.DefineInFrame("y", 2)
+	inner.DefineInFrame("x", 3)
+	if x, ok := inner.Lookup("x"); !ok || x != 3 {
+		t.Fail()
+	}
+	if y, ok := inner.Lookup("y"); !ok || y != 2 {
+		t.Fail()
+	}
+	if inner.PopFrame() != env {
+		t.Fail()
+	}
+	if x, ok := env.Lookup("x"); !ok || x != 1 {
+		t.Fail()
+	}
+	if y, ok := env.Lookup("y"); ok || y != nil {
+		t.Fail()
+	}
+	inner.DefineInFrame("y", 4)
+	if y, _ := inner.Lookup("y"); y != 4 || inner.Frame.Length() != 2 {
+		t.Fail()
+	}
+}
+
 func TestSets(t *testing.T) {
 	t.Run("SetLessThanEqual", func(t *testing.T) {
 		if !list.SetLessThanEqual(list.List("a"), list.List("a", "b", "a"), list.List("a", "b", "c", "c")) {
@@ -134,3 +134,35 @@ func Equal(x, y interface{}) bool {
 		y = pair2.Cdr
 	}
 }
+
+// EqualWith is like Equal, but compares corresponding elements with eq
+// instead of ==. The tails of dotted lists, and x and y themselves if
+// neither of them is a list, are also compared with eq. A list is never equal
+// to a value that is not a list. Nested lists can be compared structurally by
+// calling EqualWith recursively from eq.
+//
+//   EqualWith(List(1, 2), List(1.0, 2.0), func(x, y interface{}) bool {
+//     return float64(x.(int)) == y.(float64)
+//   }) => true
+//
+// It is an error to apply EqualWith to circular lists.
+func EqualWith(x, y interface{}, eq func(x, y interface{}) bool) bool {
+	for {
+		pair1, ok1 := x.(*Pair)
+		pair2, ok2 := y.(*Pair)
+		if !ok1 || !ok2 {
+			return !ok1 && !ok2 && eq(x, y)
+		}
+		if pair1 == pair2 {
+			return true
+		}
+		if pair1 == nil || pair2 == nil {
+			return false
+		}
+		if !eq(pair1.Car, pair2.Car) {
+			return false
+		}
+		x = pair1.Cdr
+		y = pair2.Cdr
+	}
+}
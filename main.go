@@ -1,41 +1,213 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pcostanza/slick/reader"
 
 	"github.com/pcostanza/slick/compiler"
 )
 
-func main() {
-	in, err := reader.NewReader(nil, os.Args[1], nil, nil)
+var (
+	watch         = flag.Bool("watch", false, "recompile whenever the input file or a plugin it uses changes")
+	macroTimeout  = flag.Duration("macro-timeout", 0, "abort macro expansions that take longer than the given duration")
+	maxExpansions = flag.Int("max-expansions", compiler.DefaultMaxExpansions, "maximum number of macro expansions per top-level declaration, or 0 for no limit")
+	isolateMacros = flag.Bool("isolate-macros", false, "run macros without access to the filesystem and the network (Linux only)")
+	internQuoted  = flag.Bool("intern-quoted", false, "share a single variable between identical quoted lists")
+	tags          = flag.String("tags", "", "comma-separated list of additional build tags for conditional import and use clauses")
+	pluginHost    = flag.String(compiler.PluginHostFlag[1:], "", "serve the macros of the given plugin binary (used internally)")
+	pluginHostExe = flag.String("plugin-host-exe", "", "load plugins into plugin host processes started from the given slick executable, for platforms without plugin support")
+	doc           = flag.String("doc", "", "list the macros exported by the plugin with the given import path")
+	stream        = flag.Bool("stream", false, "keep compiled declarations in a temporary file instead of in memory, for very large input files")
+	alignLines    = flag.Bool("align-lines", false, "pad the generated code so that statements start on the same lines as in the input file where possible")
+	packageMode   = flag.Bool("package", false, "compile the input files of a package, each to the .go file with the same name, and report redefinitions across them")
+)
+
+// lazyFile creates the output file on the first write, so that no output
+// file is created when compilation fails.
+type lazyFile struct {
+	name string
+	file *os.File
+}
+
+func (f *lazyFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		file, err := os.Create(f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+	}
+	return f.file.Write(p)
+}
+
+func (f *lazyFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func compile(config compiler.Config, input, output string) error {
+	in, err := reader.NewReader(nil, input, nil, nil)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
 
-	output, err := compiler.Compile(in)
+	out := &lazyFile{name: output}
+	err = config.CompileTo(in, out)
+	for _, warning := range in.Warnings {
+		fmt.Println("warning:", warning)
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// compileAll compiles the input files to the corresponding output files,
+// and reports whether all of them compiled without errors. In package
+// mode, the files are compiled as files of the same package.
+func compileAll(config compiler.Config, inputs, outputs []string) bool {
+	if *packageMode {
+		config.Package = new(compiler.Package)
 	}
+	ok := true
+	for i, input := range inputs {
+		if err := compile(config, input, outputs[i]); err != nil {
+			fmt.Println(err)
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Println("done")
+	}
+	return ok
+}
 
-	out, err := os.Create(os.Args[2])
+// printManifest lists the macros in the manifest of the plugin with the
+// given import path.
+func printManifest(config compiler.Config, path string) error {
+	manifest, err := config.PluginManifest(path)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("plugin %v has no manifest", path)
+	}
+	for _, info := range manifest {
+		if info.Shape != "" {
+			fmt.Println(info.Shape)
+		} else {
+			fmt.Println(info.Name)
+		}
+		for _, line := range strings.Split(info.Doc, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Println("\t" + line)
+			}
+		}
+	}
+	return nil
+}
+
+type stamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func stamps(files []string) map[string]stamp {
+	result := make(map[string]stamp)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			result[file] = stamp{info.Size(), info.ModTime()}
+		}
+	}
+	return result
+}
+
+func changed(old map[string]stamp) bool {
+	for file, s := range old {
+		info, err := os.Stat(file)
+		if err != nil || info.Size() != s.size || !info.ModTime().Equal(s.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	flag.Parse()
+
+	if *pluginHost != "" {
+		if err := compiler.ServePluginHost(*pluginHost, os.NewFile(3, "in"), os.NewFile(4, "out")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	config := compiler.Config{
+		Macros: compiler.MacroPolicy{
+			Timeout:       *macroTimeout,
+			MaxExpansions: *maxExpansions,
+			Isolated:      *isolateMacros,
+		},
+		Cache:                compiler.NewMacroCache(0),
+		UsePluginHosts:       *watch || *pluginHostExe != "",
+		PluginHostExecutable: *pluginHostExe,
+		InternQuotedLists:    *internQuoted,
+		AlignLines:           *alignLines,
+		Stream:               *stream,
+	}
+	if config.Macros.MaxExpansions == 0 {
+		config.Macros.MaxExpansions = -1
+	}
+	if *tags != "" {
+		config.BuildTags = strings.Split(*tags, ",")
+	}
+
+	if *doc != "" {
+		if err := printManifest(config, *doc); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var inputs, outputs []string
+	switch {
+	case *packageMode && flag.NArg() > 0:
+		for _, input := range flag.Args() {
+			inputs = append(inputs, input)
+			outputs = append(outputs, strings.TrimSuffix(input, ".slick")+".go")
+		}
+	case !*packageMode && flag.NArg() == 2:
+		inputs, outputs = []string{flag.Arg(0)}, []string{flag.Arg(1)}
+	default:
+		fmt.Println("usage: slick [flags] input.slick output.go")
+		fmt.Println("       slick [flags] -package input.slick ...")
+		flag.PrintDefaults()
+		os.Exit(2)
 	}
 
-	if _, err = out.Write(output); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if !*watch {
+		if !compileAll(config, inputs, outputs) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if err = out.Close(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for {
+		compileAll(config, inputs, outputs)
+		deps := stamps(append(inputs[:len(inputs):len(inputs)], compiler.PluginHostFiles()...))
+		for !changed(deps) {
+			time.Sleep(500 * time.Millisecond)
+		}
 	}
-	fmt.Println("done")
 }
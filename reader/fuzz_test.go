@@ -0,0 +1,51 @@
+package reader_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+var seeds = []string{
+	`(package p)`,
+	`(package p) (import "fmt") (func main () () (fmt:Println "hello, world"))`,
+	`(a (b . c) 'd ` + "`" + `(e ,f ,@g))`,
+	`"string \x41\101A\U00000041\n" #"raw string" #\a #\x41 #é #\newline`,
+	`1 1.5 0x1p-2 1e3 2i 0b101 0o17 1_000`,
+	`pkg:ident :keyword _ _x pkg:_x a:b:c`,
+	`; comment
+#; (ignored form) #| block #| nested |# comment |# x`,
+	`(unterminated "string`,
+	`#\ #\xZZ "\q" 1e 0x ((((`,
+	")))\x00\xff\xfe",
+}
+
+// FuzzRead checks that the reader reports errors instead of panicking on
+// arbitrary input, and that the source ranges of the forms it reads are
+// within the source.
+func FuzzRead(f *testing.F) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		rd, err := reader.NewReader(nil, "fuzz.slick", src, nil)
+		if err != nil {
+			return
+		}
+		base := rd.File().Base()
+		for {
+			form := rd.Read()
+			if form == io.EOF {
+				break
+			}
+			if pair, ok := form.(*list.Pair); ok && pair != nil {
+				pos, end := rd.FormPos(pair)
+				if pos.IsValid() && (int(pos) < base || int(end) > base+len(src) || end < pos) {
+					t.Errorf("invalid range %v-%v for form %v", pos, end, pair)
+				}
+			}
+		}
+	})
+}
@@ -37,7 +37,6 @@ import (
 	"math/big"
 	"path"
 	"strconv"
-	"strings"
 	"unicode"
 	"unicode/utf8"
 
@@ -86,6 +85,7 @@ func CopyTable(rt *Table) *Table {
 			dt[skey] = sval
 		}
 		result.dispatchMacroRunes[key] = dt
+		result.macroRunes[key] = dispatchMacroReader(dt)
 	}
 	for key, val := range rt.terminating {
 		result.terminating[key] = val
@@ -147,15 +147,35 @@ func (rt *Table) GetDispatchMacroRune(dispRune, subRune rune) DispatchMacro {
 
 type PackageResolver struct {
 	PackageToPath, PathToPackage map[string]string
+	// Aliases maps import paths to the preferred names for packages that
+	// are imported automatically by EnclosePackage. Tools that compile
+	// several files preload them, for example with the names chosen for a
+	// previous file of the same package, or with project-wide canonical
+	// names, to get consistent package names across files.
+	Aliases map[string]string
 }
 
 func NewPackageResolver() *PackageResolver {
 	return &PackageResolver{
-		make(map[string]string),
-		make(map[string]string),
+		PackageToPath: make(map[string]string),
+		PathToPackage: make(map[string]string),
+		Aliases:       make(map[string]string),
 	}
 }
 
+// Derive returns a new package resolver for another file, which prefers
+// the aliases of r, and the package names that are used in the file of r.
+func (r *PackageResolver) Derive() *PackageResolver {
+	result := NewPackageResolver()
+	for pkgPath, name := range r.Aliases {
+		result.Aliases[pkgPath] = name
+	}
+	for pkgPath, name := range r.PathToPackage {
+		result.Aliases[pkgPath] = name
+	}
+	return result
+}
+
 func (r PackageResolver) ResolveSymbol(pkg, ident string) (*lib.Symbol, error) {
 	if pkg == "" || pkg == "_keyword" {
 		return lib.Intern(pkg, ident), nil
@@ -166,14 +186,14 @@ func (r PackageResolver) ResolveSymbol(pkg, ident string) (*lib.Symbol, error) {
 	return nil, fmt.Errorf("The package of symbol %v:%v cannot be resolved.", pkg, ident)
 }
 
-func (r *PackageResolver) EncloseSymbol(sym *lib.Symbol) (*lib.Symbol, bool) {
-	if sym.Package == "" || sym.Package == "_keyword" {
-		return sym, false
+func (r *PackageResolver) EnclosePackage(pkgPath string) (string, bool) {
+	if name, ok := r.PathToPackage[pkgPath]; ok {
+		return name, false
 	}
-	if name, ok := r.PathToPackage[sym.Package]; ok {
-		return lib.Intern(name, sym.Identifier), false
+	newName := path.Base(pkgPath)
+	if alias, ok := r.Aliases[pkgPath]; ok {
+		newName = alias
 	}
-	newName := path.Base(sym.Package)
 	if _, ok := r.PackageToPath[newName]; ok {
 		for counter := 1; ; counter++ {
 			modName := fmt.Sprintf("%v%v", newName, counter)
@@ -183,9 +203,17 @@ func (r *PackageResolver) EncloseSymbol(sym *lib.Symbol) (*lib.Symbol, bool) {
 			}
 		}
 	}
-	r.PackageToPath[newName] = sym.Package
-	r.PathToPackage[sym.Package] = newName
-	return lib.Intern(newName, sym.Identifier), true
+	r.PackageToPath[newName] = pkgPath
+	r.PathToPackage[pkgPath] = newName
+	return newName, true
+}
+
+func (r *PackageResolver) EncloseSymbol(sym *lib.Symbol) (*lib.Symbol, bool) {
+	if sym.Package == "" || sym.Package == "_keyword" {
+		return sym, false
+	}
+	name, enclosed := r.EnclosePackage(sym.Package)
+	return lib.Intern(name, sym.Identifier), enclosed
 }
 
 type formRange struct {
@@ -196,9 +224,12 @@ type Reader struct {
 	*PackageResolver
 	file     *token.File
 	Errors   scanner.ErrorList
+	Warnings scanner.ErrorList
 	src      []byte
 	table    *Table
 	ranges   map[*list.Pair]formRange
+	symbols  map[string]*lib.Symbol // unqualified symbols read so far
+	keywords map[string]*lib.Symbol // keywords read so far
 	ch       rune
 	offset   int
 	rdOffset int
@@ -247,6 +278,8 @@ func NewReader(fset *token.FileSet, filename string, src interface{}, table *Tab
 		src:             source,
 		table:           table,
 		ranges:          make(map[*list.Pair]formRange),
+		symbols:         make(map[string]*lib.Symbol),
+		keywords:        make(map[string]*lib.Symbol),
 		ch:              ' ',
 	}
 	rd.NextRune()
@@ -267,12 +300,43 @@ func (rd *Reader) Table() *Table {
 	return rd.table
 }
 
+func (rd *Reader) SetTable(table *Table) {
+	rd.table = table
+}
+
 func (rd *Reader) Offset() int {
 	return rd.offset
 }
 
 func (rd *Reader) AddForm(form *list.Pair, from, to int) {
-	rd.ranges[form] = formRange{from: from, to: to}
+	if rd.ranges != nil {
+		rd.ranges[form] = formRange{from: from, to: to}
+	}
+}
+
+// SetRecordPositions determines whether the reader records the source
+// ranges of the lists it reads, as reported by FormPos. Positions are
+// recorded by default. Tools that read large inputs, for example
+// generated data files, and that do not need the positions of forms can
+// switch recording off for higher throughput. Errors are reported with
+// positions either way.
+func (rd *Reader) SetRecordPositions(record bool) {
+	switch {
+	case record && rd.ranges == nil:
+		rd.ranges = make(map[*list.Pair]formRange)
+	case !record:
+		rd.ranges = nil
+	}
+}
+
+// ForgetPositions discards the recorded source ranges of the forms that
+// have been read so far, so that the forms can be garbage collected when
+// they are no longer needed otherwise. FormPos reports no positions for
+// them afterwards.
+func (rd *Reader) ForgetPositions() {
+	if rd.ranges != nil {
+		rd.ranges = make(map[*list.Pair]formRange)
+	}
 }
 
 func (rd *Reader) FormPos(form *list.Pair) (pos, end token.Pos) {
@@ -346,8 +410,10 @@ func (rd *Reader) Error(offset int, msg string) {
 	rd.Errors.Add(rd.file.Position(rd.file.Pos(offset)), msg)
 }
 
+// isDigit reports whether r starts a number. Other Unicode digits are
+// read as part of symbols, because readNumber accepts only ASCII digits.
 func isDigit(r rune) bool {
-	return '0' <= r && r <= '9' || r >= utf8.RuneSelf && unicode.IsDigit(r)
+	return '0' <= r && r <= '9'
 }
 
 func (rd *Reader) SkipSpace() {
@@ -494,9 +560,20 @@ func stringMacro(rd *Reader) interface{} {
 		}
 		rd.NextRune()
 	}
+	// Strings without escapes are sliced from the source.
+	start := rd.offset + utf8.RuneLen(d)
+	r := rd.NextRune()
+	for r != d && r != '\\' && r != -1 && r != '\n' {
+		r = rd.NextRune()
+	}
+	if r == d {
+		str := string(rd.src[start:rd.offset])
+		rd.NextRune()
+		return str
+	}
 	var result bytes.Buffer
-	for {
-		r := rd.NextRune()
+	result.Write(rd.src[start:rd.offset])
+	for ; ; r = rd.NextRune() {
 		if r == -1 || r == '\n' {
 			rd.Error(offset, "incomplete string literal")
 			rd.NextRune()
@@ -603,7 +680,12 @@ func rawStringMacro(rd *Reader, _ rune, dispatchRuneOffset int) interface{} {
 
 func runeMacro(rd *Reader, _ rune, dispatchRuneOffset int) interface{} {
 	r := rd.NextRune()
+	if r == -1 {
+		rd.Error(dispatchRuneOffset, "incomplete rune literal")
+		return rd.BadForm(dispatchRuneOffset, rd.offset)
+	}
 	if r != '\\' {
+		rd.NextRune()
 		return r
 	}
 	r = rd.NextRune()
@@ -643,21 +725,21 @@ func runeMacro(rd *Reader, _ rune, dispatchRuneOffset int) interface{} {
 	case 'x':
 		rd.NextRune()
 		if b, ok := rd.readHexBytes(2); ok {
-			return b
+			return rune(b)
 		}
 	case '0', '1', '2', '3', '4', '5', '6', '7':
 		if b, ok := rd.readOctalByte(); ok {
-			return b
+			return rune(b)
 		}
 	case 'u':
 		rd.NextRune()
 		if u, ok := rd.readHexBytes(4); ok {
-			return u
+			return rune(u)
 		}
 	case 'U':
 		rd.NextRune()
 		if u, ok := rd.readHexBytes(8); ok {
-			return u
+			return rune(u)
 		}
 	default:
 		rd.Error(dispatchRuneOffset, "invalid escape in rune literal")
@@ -713,63 +795,67 @@ func dispatchMacroReader(subtable map[rune]DispatchMacro) Macro {
 	}
 }
 
-func (rd *Reader) readIdentifier() string {
+// readIdentifier returns the identifier at the current offset as a slice
+// of the source, without copying it.
+func (rd *Reader) readIdentifier() []byte {
 	offset := rd.offset
-	var buf bytes.Buffer
-	r := rd.Rune()
-	for {
-		if !validRune(r) || r == ':' || rd.table.terminating[r] {
-			return buf.String()
-		}
-		if _, err := buf.WriteRune(r); err != nil {
-			rd.Error(offset, err.Error())
-			for {
-				r = rd.NextRune()
-				if !validRune(r) || r == ':' || rd.table.terminating[r] {
-					return buf.String()
-				}
-			}
-		}
-		r = rd.NextRune()
+	for r := rd.Rune(); validRune(r) && r != ':' && !rd.table.terminating[r]; r = rd.NextRune() {
 	}
+	return rd.src[offset:rd.offset]
+}
+
+// intern returns the unqualified symbol or keyword with the given
+// identifier. Symbols are cached per reader, so that reading a symbol
+// that has been read before does not allocate.
+func (rd *Reader) intern(cache map[string]*lib.Symbol, pkg string, ident []byte) *lib.Symbol {
+	if sym, ok := cache[string(ident)]; ok {
+		return sym
+	}
+	sym := lib.Intern(pkg, string(ident))
+	cache[sym.Identifier] = sym
+	return sym
+}
+
+func isReserved(ident []byte) bool {
+	return len(ident) > 1 && ident[0] == '_'
 }
 
 func (rd *Reader) readSymbol() interface{} {
 	offset := rd.offset
 	ok := true
 	pkg := rd.readIdentifier()
-	if (pkg != "_") && strings.HasPrefix(pkg, "_") {
+	if isReserved(pkg) {
 		rd.Error(offset, "invalid package name or identifier")
 		ok = false
 	}
 	if rd.Rune() != ':' {
-		if pkg == "" {
+		if len(pkg) == 0 {
 			rd.Error(offset, "empty identifier")
 			ok = false
 		}
 		if ok {
-			return lib.Intern("", pkg)
+			return rd.intern(rd.symbols, "", pkg)
 		}
 		return rd.BadForm(offset, rd.offset)
 	}
-	if pkg == "" {
-		pkg = "_keyword"
-	}
 	rd.NextRune()
 	ident := rd.readIdentifier()
 	if rd.Rune() == ':' {
 		rd.Error(offset, "invalid package prefix")
 		ok = false
-	} else if ident == "" {
+	} else if len(ident) == 0 {
 		rd.Error(offset, "empty identifier")
 		ok = false
 	}
-	if (ident != "_") && strings.HasPrefix(ident, "_") {
+	if isReserved(ident) {
 		rd.Error(offset, "invalid identifier")
 		ok = false
 	}
+	if ok && len(pkg) == 0 {
+		return rd.intern(rd.keywords, "_keyword", ident)
+	}
 	if ok {
-		if sym, err := rd.ResolveSymbol(pkg, ident); err != nil {
+		if sym, err := rd.ResolveSymbol(string(pkg), string(ident)); err != nil {
 			return rd.BadForm(offset, rd.offset)
 		} else {
 			return sym
@@ -792,21 +878,14 @@ func isNumRune(r rune) bool {
 
 func (rd *Reader) readNumber() interface{} {
 	offset := rd.offset
-	var buf bytes.Buffer
 	var flt bool
 	r := rd.Rune()
 	for ; isNumRune(r); r = rd.NextRune() {
 		if r == '.' || r == 'e' || r == 'E' || r == 'p' || r == 'P' {
 			flt = true
 		}
-		if _, err := buf.WriteRune(r); err != nil {
-			rd.Error(offset, err.Error())
-			for isNumRune(rd.NextRune()) {
-			}
-			return rd.BadForm(offset, rd.offset)
-		}
 	}
-	str := buf.String()
+	str := string(rd.src[offset:rd.offset])
 	if r == 'i' {
 		rd.NextRune()
 		val, err := strconv.ParseFloat(str, 64)
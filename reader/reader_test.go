@@ -0,0 +1,98 @@
+package reader_test
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pcostanza/slick/list"
+	"github.com/pcostanza/slick/reader"
+)
+
+// generated returns a large source file, similar to generated code.
+func generated(n int) string {
+	var b strings.Builder
+	b.WriteString("(package p)\n(import \"fmt\")\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `(func f%v ((x int) (y string)) ((_ int))
+  (:= z (+ x %v 3.5e2 0x10))
+  (if (> z 42)
+    (fmt:Println "large:\t" y z #\a)
+    (fmt:Println "small" :key))
+  (return (len y)))
+`, i, i)
+	}
+	return b.String()
+}
+
+func readAll(tb testing.TB, rd *reader.Reader) (forms int) {
+	rd.PackageToPath["fmt"] = "fmt"
+	for rd.Read() != io.EOF {
+		forms++
+	}
+	if err := rd.Errors.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return forms
+}
+
+func TestRecordPositions(t *testing.T) {
+	src := generated(2)
+	rd, err := reader.NewReader(nil, "test.slick", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.SetRecordPositions(false)
+	rd.PackageToPath["fmt"] = "fmt"
+	rd.Read()
+	rd.Read()
+	form := rd.Read().(*list.Pair)
+	if pos, _ := rd.FormPos(form); pos.IsValid() {
+		t.Errorf("position %v recorded for %v", pos, form)
+	}
+	rd.SetRecordPositions(true)
+	form = rd.Read().(*list.Pair)
+	if pos, _ := rd.FormPos(form); rd.File().Position(pos).Line != 9 {
+		t.Errorf("unexpected position %v for %v", rd.File().Position(pos), form)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	r := reader.NewPackageResolver()
+	r.Aliases["example.com/a/errors"] = "aerrors"
+	r.PackageToPath["aerrors"] = "example.com/other"
+	if name, enclosed := r.EnclosePackage("example.com/a/errors"); !enclosed || name != "aerrors1" {
+		t.Errorf("unexpected name %v", name)
+	}
+	if name, enclosed := r.EnclosePackage("example.com/b/errors"); !enclosed || name != "errors" {
+		t.Errorf("unexpected name %v", name)
+	}
+	next := r.Derive()
+	if len(next.PackageToPath) != 0 || len(next.PathToPackage) != 0 {
+		t.Errorf("packages %v inherited", next.PackageToPath)
+	}
+	for path, name := range map[string]string{"example.com/a/errors": "aerrors1", "example.com/b/errors": "errors"} {
+		if enclosed, _ := next.EnclosePackage(path); enclosed != name {
+			t.Errorf("%v enclosed as %v instead of %v", path, enclosed, name)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	src := generated(1000)
+	for _, record := range []bool{true, false} {
+		b.Run(fmt.Sprintf("positions=%v", record), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rd, err := reader.NewReader(nil, "bench.slick", src, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rd.SetRecordPositions(record)
+				readAll(b, rd)
+			}
+		})
+	}
+}